@@ -4,12 +4,84 @@ import (
     "fmt"
     "net/http"
     "os"
+    "strconv"
+    "time"
 
     "shard/internal/handlers"
     "shard/internal/node"
 )
 func main() {
-    n, err := node.New("out")
+    config := node.DefaultConfig()
+    if value := os.Getenv("SHARD_SIZE"); value != "" {
+        size, err := strconv.ParseInt(value, 10, 64)
+        if err != nil {
+            fmt.Printf("Invalid SHARD_SIZE %q: %s\n", value, err)
+            return
+        }
+        config.ShardSize = size
+    }
+    if value := os.Getenv("CAPACITY"); value != "" {
+        capacity, err := strconv.ParseInt(value, 10, 64)
+        if err != nil {
+            fmt.Printf("Invalid CAPACITY %q: %s\n", value, err)
+            return
+        }
+        config.Capacity = capacity
+    }
+    if value := os.Getenv("REPLICAS"); value != "" {
+        replicas, err := strconv.Atoi(value)
+        if err != nil {
+            fmt.Printf("Invalid REPLICAS %q: %s\n", value, err)
+            return
+        }
+        config.Replicas = replicas
+    }
+    if value := os.Getenv("CACHE_SIZE"); value != "" {
+        size, err := strconv.ParseInt(value, 10, 64)
+        if err != nil {
+            fmt.Printf("Invalid CACHE_SIZE %q: %s\n", value, err)
+            return
+        }
+        config.CacheSize = size
+    }
+    if value := os.Getenv("SCRUB_INTERVAL"); value != "" {
+        interval, err := time.ParseDuration(value)
+        if err != nil {
+            fmt.Printf("Invalid SCRUB_INTERVAL %q: %s\n", value, err)
+            return
+        }
+        config.ScrubInterval = interval
+    }
+    if value := os.Getenv("COMPACT_INTERVAL"); value != "" {
+        interval, err := time.ParseDuration(value)
+        if err != nil {
+            fmt.Printf("Invalid COMPACT_INTERVAL %q: %s\n", value, err)
+            return
+        }
+        config.CompactInterval = interval
+    }
+    if value := os.Getenv("TOMBSTONE_TTL"); value != "" {
+        ttl, err := time.ParseDuration(value)
+        if err != nil {
+            fmt.Printf("Invalid TOMBSTONE_TTL %q: %s\n", value, err)
+            return
+        }
+        config.TombstoneTTL = ttl
+    }
+    if value := os.Getenv("WORKERS"); value != "" {
+        workers, err := strconv.Atoi(value)
+        if err != nil {
+            fmt.Printf("Invalid WORKERS %q: %s\n", value, err)
+            return
+        }
+        config.Workers = workers
+    }
+    config.Backend = os.Getenv("SHARD_BACKEND")
+    if value := os.Getenv("DATA_DIR"); value != "" {
+        config.DataDir = value
+    }
+
+    n, err := node.NewWithConfig("out", config)
     if err != nil {
         fmt.Printf("Failed to start P2P node: %s\n", err)
         return
@@ -19,7 +91,11 @@ func main() {
     h := handlers.New(n)
     http.HandleFunc("/upload", h.Upload)
     http.HandleFunc("/file", h.GetFile)
+    http.HandleFunc("DELETE /file", h.DeleteFile)
     http.HandleFunc("/shardMap", h.GetShardMap)
+    http.HandleFunc("/usage", h.Usage)
+    http.HandleFunc("/cache", h.CacheStats)
+    http.HandleFunc("/scrub", h.ScrubStats)
     http.HandleFunc("/health", h.HealthHandler)
 
     port := os.Getenv("PORT")
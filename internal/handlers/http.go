@@ -1,14 +1,16 @@
 package handlers
 
 import (
-	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"mime"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 
+	"shard/internal/sharding"
 	"shard/internal/types"
 )
 
@@ -23,88 +25,216 @@ func New(node types.Node) *Handler {
 func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
 	r.ParseMultipartForm(10 << 20) // 10 MB
 
-	file, _, err := r.FormFile("file")
+	file, fileHeader, err := r.FormFile("file")
 	if err != nil {
 		http.Error(w, "Unable to read the file", http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
 
-	hash := sha256.New()
-	_, err = io.Copy(hash, file)
+	opts, err := parseUploadOptions(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	opts.Filename = fileHeader.Filename
+	opts.ContentType = fileHeader.Header.Get("Content-Type")
 
-	hashInBytes := hash.Sum(nil)
-	finalFilename := hex.EncodeToString(hashInBytes)
-
-	dst, err := os.Create(finalFilename)
+	// Split straight from the upload, hashing it on the way to name the
+	// file. The shards reach peers in the background.
+	finalFilename, err := h.node.DistributeFile("", file, opts)
 	if err != nil {
-		http.Error(w, "Unable to save the file", http.StatusInternalServerError)
+		http.Error(w, "Unable to shard the file", http.StatusInternalServerError)
 		return
 	}
-	defer dst.Close()
 
-	file.Seek(0, io.SeekStart)
-	_, err = io.Copy(dst, file)
-	if err != nil {
-		http.Error(w, "Failed to write file", http.StatusInternalServerError)
-		return
+	fmt.Fprintln(w, "File uploaded successfully!")
+	if id, err := sharding.DigestCID(finalFilename); err == nil {
+		// Either form can be passed as /file?hash=
+		fmt.Fprintf(w, "Hash: %s\nCID: %s\n", finalFilename, id)
+	}
+	if opts.Key != nil {
+		// Nobody keeps the key, the uploader needs it to read the file back
+		fmt.Fprintf(w, "Key: %s\n", hex.EncodeToString(opts.Key))
 	}
+}
 
-	fmt.Fprintln(w, "File uploaded successfully!")
-	go func() {
-		h.node.DistributeFile(finalFilename)
-		// Respond to the client indicating success
-		fmt.Fprintln(w, "File distributed to peers!")
-	}()
+// parseUploadOptions reads the optional sharding settings of an upload
+func parseUploadOptions(r *http.Request) (types.UploadOptions, error) {
+	var opts types.UploadOptions
+	var err error
+
+	if value := r.FormValue("data_shards"); value != "" {
+		opts.DataShards, err = strconv.Atoi(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid data_shards: %v", err)
+		}
+	}
+	if value := r.FormValue("parity_shards"); value != "" {
+		opts.ParityShards, err = strconv.Atoi(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid parity_shards: %v", err)
+		}
+	}
+
+	opts.Chunker = r.FormValue("chunker")
+	switch opts.Chunker {
+	case "", types.ChunkerFixed, types.ChunkerContentDefined:
+	default:
+		return opts, fmt.Errorf("unknown chunker %q", opts.Chunker)
+	}
+
+	opts.Compression = r.FormValue("compression")
+	switch opts.Compression {
+	case "", types.CompressionNone, types.CompressionZstd:
+	default:
+		return opts, fmt.Errorf("unknown compression %q", opts.Compression)
+	}
+
+	if value := r.FormValue("encrypt"); value != "" {
+		encrypt, err := strconv.ParseBool(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid encrypt: %v", err)
+		}
+		if encrypt {
+			opts.Key, err = sharding.NewFileKey()
+			if err != nil {
+				return opts, err
+			}
+		}
+	}
+
+	if value := r.FormValue("shard_size"); value != "" {
+		opts.ShardSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid shard_size: %v", err)
+		}
+		if err := sharding.ValidateShardSize(opts.ShardSize); err != nil {
+			return opts, err
+		}
+	}
+
+	if value := r.FormValue("replicas"); value != "" {
+		opts.Replicas, err = strconv.Atoi(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid replicas: %v", err)
+		}
+		if opts.Replicas < 1 {
+			return opts, fmt.Errorf("replicas must be at least 1, got %d", opts.Replicas)
+		}
+	}
+
+	scheme := sharding.Scheme{DataShards: opts.DataShards, ParityShards: opts.ParityShards}
+	if err := scheme.Validate(); err != nil {
+		return opts, err
+	}
+	return opts, nil
 }
 
 func (h *Handler) GetFile(w http.ResponseWriter, r *http.Request) {
-	hash := r.URL.Query().Get("hash")
-	if hash == "" {
+	id := r.URL.Query().Get("hash")
+	if id == "" {
 		http.Error(w, "Hash parameter is required", http.StatusBadRequest)
 		return
 	}
+	// Files are stored under their hex SHA-256, CIDs are mapped onto it
+	hash, err := sharding.ParseFileID(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Try to open the file locally first
-	// TODO: use the shards, not the hash
-	// TODO: refactor to not use hardcoded path
-	// TODO: refactor nesting
-	file, err := os.Open(filepath.Join("out", hash))
+	// A range of a file we don't hold is read from the shards covering it
+	if r.Header.Get("Range") != "" && !h.node.IsCached(hash) && h.getFileRange(w, r, hash) {
+		return
+	}
+
+	if value := r.URL.Query().Get("key"); value != "" {
+		h.getEncryptedFile(w, hash, value)
+		return
+	}
+
+	// Serve the cached copy, the node rebuilds it from peers when it was
+	// never fetched or has been evicted
+	file, err := h.node.OpenFile(hash)
 	if err != nil {
-		if os.IsNotExist(err) {
-			// File not found locally, try to get it from peers
-			err = h.node.RequestFileFromPeers(hash)
-			if err != nil {
-				http.Error(w, "File not found in network", http.StatusNotFound)
-				return
-			}
-			// Now try to open the file again
-			file, err = os.Open(filepath.Join("out", hash))
-			if err != nil {
-				http.Error(w, "Error opening file after retrieval", http.StatusInternalServerError)
-				return
-			}
-		} else {
-			http.Error(w, "Error opening file", http.StatusInternalServerError)
-			return
-		}
+		writeFileError(w, err)
+		return
 	}
 	defer file.Close()
 
-	// Set content type header to application/octet-stream for binary file download
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", hash))
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Error opening file", http.StatusInternalServerError)
+		return
+	}
+
+	h.setFileHeaders(w, hash)
+
+	// Copy the file to the response writer, honoring Range headers
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
 
-	// Copy the file to the response writer
-	_, err = io.Copy(w, file)
+// getEncryptedFile serves a file that is decrypted on the fly with the key
+// from the request, the plaintext is never cached
+func (h *Handler) getEncryptedFile(w http.ResponseWriter, hash string, keyHex string) {
+	key, err := parseKey(keyHex)
 	if err != nil {
-		http.Error(w, "Error sending file", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+
+	h.setFileHeaders(w, hash)
+
+	// Nothing is written to w until the file has been verified
+	err = h.node.DecryptFileFromPeers(hash, key, w)
+	if err != nil {
+		writeFileError(w, err)
+	}
+}
+
+// parseKey decodes a hex file key
+func parseKey(keyHex string) ([]byte, error) {
+	key, err := hex.DecodeString(keyHex)
+	if err != nil || len(key) != sharding.KeySize {
+		return nil, fmt.Errorf("Invalid key")
+	}
+	return key, nil
+}
+
+// writeFileError reports why a file could not be retrieved
+func writeFileError(w http.ResponseWriter, err error) {
+	var integrityErr *types.IntegrityError
+	switch {
+	case errors.As(err, &integrityErr):
+		http.Error(w, integrityErr.Error(), http.StatusBadGateway)
+	case errors.Is(err, sharding.ErrKeyRequired):
+		http.Error(w, "File is encrypted, pass its key", http.StatusUnauthorized)
+	case errors.Is(err, sharding.ErrDecryptFailed):
+		http.Error(w, "Wrong key for this file", http.StatusForbidden)
+	case errors.Is(err, types.ErrFileDeleted):
+		http.Error(w, "File was deleted", http.StatusGone)
+	default:
+		http.Error(w, "File not found in network", http.StatusNotFound)
+	}
+}
+
+// setFileHeaders sets the download headers of a file, using the name and
+// content type recorded in its manifest when there is one
+func (h *Handler) setFileHeaders(w http.ResponseWriter, hash string) {
+	// Default to application/octet-stream for binary file download
+	contentType := "application/octet-stream"
+	filename := hash
+	if manifest, err := h.node.FileManifest(hash); err == nil {
+		if manifest.ContentType != "" {
+			contentType = manifest.ContentType
+		}
+		if manifest.Filename != "" {
+			filename = manifest.Filename
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
 }
 
 func (h *Handler) GetShardMap(w http.ResponseWriter, r *http.Request) {
@@ -121,6 +251,56 @@ func (h *Handler) GetShardMap(w http.ResponseWriter, r *http.Request) {
     go h.node.PrintShardsMap()
 }
 
+// DeleteFile deletes a file from this node and every peer
+func (h *Handler) DeleteFile(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("hash")
+	if id == "" {
+		http.Error(w, "Hash parameter is required", http.StatusBadRequest)
+		return
+	}
+	hash, err := sharding.ParseFileID(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.node.DeleteFile(hash)
+	if err != nil {
+		fmt.Printf("Error deleting file %s: %v\n", hash, err)
+		http.Error(w, "Unable to delete the file", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "File deleted successfully!")
+}
+
+// CacheStats reports the size and hit rate of the reconstructed file cache
+func (h *Handler) CacheStats(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(h.node.CacheStats())
+	if err != nil {
+		fmt.Printf("Error writing cache stats: %v\n", err)
+	}
+}
+
+// ScrubStats reports what the background scrubber found and repaired
+func (h *Handler) ScrubStats(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(h.node.ScrubStats())
+	if err != nil {
+		fmt.Printf("Error writing scrub stats: %v\n", err)
+	}
+}
+
+// Usage reports how much of its capacity this node and each of its peers use
+func (h *Handler) Usage(w http.ResponseWriter, _ *http.Request) {
+	usages := h.node.StorageUsage()
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(usages)
+	if err != nil {
+		fmt.Printf("Error writing usage: %v\n", err)
+	}
+}
+
 func (h *Handler) HealthHandler(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
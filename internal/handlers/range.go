@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	errRangeUnsupported    = errors.New("unsupported range")
+	errRangeNotSatisfiable = errors.New("range not satisfiable")
+)
+
+// getFileRange serves the Range of a request from the shards covering it. It
+// returns false when the range can't be served that way and the whole file
+// should be sent instead.
+func (h *Handler) getFileRange(w http.ResponseWriter, r *http.Request, hash string) bool {
+	var key []byte
+	if value := r.URL.Query().Get("key"); value != "" {
+		var err error
+		key, err = parseKey(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return true
+		}
+	}
+
+	// Only a manifest checked against the file hash locates ranges, the
+	// whole file is rebuilt and verified otherwise
+	manifest, ok := h.node.VerifiedManifest(hash)
+	if !ok {
+		return false
+	}
+	offset, length, err := parseRange(r.Header.Get("Range"), manifest.Size)
+	if errors.Is(err, errRangeNotSatisfiable) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", manifest.Size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	if _, _, _, err := manifest.ShardRange(offset, length); err != nil {
+		// Manifests from before raw sizes were recorded can't locate ranges
+		return false
+	}
+
+	h.setFileHeaders(w, hash)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, manifest.Size))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+
+	out := &partialContentWriter{ResponseWriter: w}
+	err = h.node.ReadFileRange(hash, key, offset, length, out)
+	if err != nil && !out.started {
+		w.Header().Del("Content-Range")
+		writeFileError(w, err)
+	}
+	return true
+}
+
+// parseRange parses a single byte range of a Range header against a file of
+// the given size and returns its offset and length. Multiple ranges are not
+// supported.
+func parseRange(header string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, errRangeUnsupported
+	}
+	startText, endText, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, errRangeUnsupported
+	}
+
+	if startText == "" {
+		// Suffix range, the last n bytes
+		n, err := strconv.ParseInt(endText, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, errRangeUnsupported
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, errRangeNotSatisfiable
+		}
+		n = min(n, size)
+		return size - n, n, nil
+	}
+
+	start, err := strconv.ParseInt(startText, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errRangeUnsupported
+	}
+	end := size - 1
+	if endText != "" {
+		end, err = strconv.ParseInt(endText, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, errRangeUnsupported
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, errRangeNotSatisfiable
+	}
+	return start, end - start + 1, nil
+}
+
+// partialContentWriter sends the 206 status with the first byte of the body,
+// so errors before that can still be reported with their own status
+type partialContentWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (p *partialContentWriter) Write(data []byte) (int, error) {
+	if !p.started {
+		p.started = true
+		p.WriteHeader(http.StatusPartialContent)
+	}
+	return p.ResponseWriter.Write(data)
+}
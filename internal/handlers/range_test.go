@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header         string
+		offset, length int64
+		err            error
+	}{
+		{"bytes=0-99", 0, 100, nil},
+		{"bytes=100-", 100, 900, nil},
+		{"bytes=-10", 990, 10, nil},
+		{"bytes=-5000", 0, 1000, nil},
+		{"bytes=990-5000", 990, 10, nil},
+		{"bytes=1000-", 0, 0, errRangeNotSatisfiable},
+		{"bytes=-0", 0, 0, errRangeNotSatisfiable},
+		{"bytes=0-1,5-9", 0, 0, errRangeUnsupported},
+		{"bytes=9-1", 0, 0, errRangeUnsupported},
+		{"items=0-1", 0, 0, errRangeUnsupported},
+	}
+
+	for _, test := range tests {
+		offset, length, err := parseRange(test.header, 1000)
+		if !errors.Is(err, test.err) {
+			t.Errorf("parseRange(%q) returned error %v, expected %v", test.header, err, test.err)
+			continue
+		}
+		if err == nil && (offset != test.offset || length != test.length) {
+			t.Errorf("parseRange(%q) = %d+%d, expected %d+%d", test.header, offset, length, test.offset, test.length)
+		}
+	}
+}
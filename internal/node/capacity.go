@@ -0,0 +1,94 @@
+package node
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"shard/internal/types"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// responseFull is the answer to a SHARD request the node has no room for
+const responseFull = "FULL"
+
+// errPeerFull is returned when a peer has no room for a shard
+var errPeerFull = errors.New("peer is full")
+
+// hasRoomFor reports whether size more bytes of shards can be stored
+func (n *P2PNode) hasRoomFor(size int64) bool {
+	return n.limits == nil || n.limits.Fits(size)
+}
+
+// localUsage returns how much of its capacity this node uses
+func (n *P2PNode) localUsage() types.Usage {
+	usage := types.Usage{Peer: n.ID.String()}
+	if n.limits != nil {
+		usage.Used, usage.Capacity = n.limits.Usage()
+	}
+	return usage
+}
+
+// StorageUsage returns the usage of this node followed by that of every peer
+// that answered
+func (n *P2PNode) StorageUsage() []types.Usage {
+	usages := []types.Usage{n.localUsage()}
+	for _, peerID := range n.knownPeers() {
+		usage, err := n.requestUsageFromPeer(peerID)
+		if err != nil {
+			fmt.Printf("Peer %s couldn't report its usage: %v\n", peerID, err)
+			continue
+		}
+		usages = append(usages, usage)
+	}
+	return usages
+}
+
+// handleUsageRequest answers with the bytes used and the capacity
+func (n *P2PNode) handleUsageRequest(stream network.Stream) {
+	usage := n.localUsage()
+	_, err := stream.Write([]byte(fmt.Sprintf("OK\n%d %d\n", usage.Used, usage.Capacity)))
+	if err != nil {
+		fmt.Printf("Error sending usage response: %v\n", err)
+	}
+}
+
+// requestUsageFromPeer asks a peer how much of its capacity it uses
+func (n *P2PNode) requestUsageFromPeer(peerID peer.ID) (types.Usage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := n.host.NewStream(ctx, peerID, "/file/1.0.0")
+	if err != nil {
+		return types.Usage{}, fmt.Errorf("failed to create stream: %v", err)
+	}
+	defer stream.Close()
+
+	_, err = stream.Write([]byte(requestTypeUsage + "\n"))
+	if err != nil {
+		return types.Usage{}, fmt.Errorf("failed to send usage request: %v", err)
+	}
+
+	reader := bufio.NewReader(stream)
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		return types.Usage{}, fmt.Errorf("failed to read response: %v", err)
+	}
+	if strings.TrimSpace(response) != "OK" {
+		return types.Usage{}, fmt.Errorf("peer refused usage request: %s", strings.TrimSpace(response))
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return types.Usage{}, fmt.Errorf("failed to read usage: %v", err)
+	}
+
+	usage := types.Usage{Peer: peerID.String()}
+	_, err = fmt.Sscanf(line, "%d %d", &usage.Used, &usage.Capacity)
+	if err != nil {
+		return types.Usage{}, fmt.Errorf("invalid usage response %q: %v", line, err)
+	}
+	return usage, nil
+}
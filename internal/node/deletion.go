@@ -0,0 +1,353 @@
+package node
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"shard/internal/sharding"
+	"shard/internal/types"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// maxTombstoneSkew is how far ahead of our clock a peer's tombstone may be
+// dated. One from further ahead would outlive every later upload.
+const maxTombstoneSkew = 5 * time.Minute
+
+// tombstone records that a file was deleted, so peers that were offline at
+// the time, or still hold the file's shards, can't bring it back. Uploading
+// the file again marks it restored, peers keep whichever change is newest.
+// Tombstones are dropped once Config.TombstoneTTL has passed.
+type tombstone struct {
+	Hash     string
+	Deleted  time.Time
+	Restored time.Time
+}
+
+// updated returns when the file was last deleted or restored
+func (s tombstone) updated() time.Time {
+	if s.Restored.After(s.Deleted) {
+		return s.Restored
+	}
+	return s.Deleted
+}
+
+// deleted reports whether the file wasn't restored since it was deleted
+func (s tombstone) deleted() bool {
+	return !s.Restored.After(s.Deleted)
+}
+
+// DeleteFile deletes a file here and on every peer. Peers that are offline
+// get the tombstone when they next connect.
+func (n *P2PNode) DeleteFile(hash string) error {
+	stone := tombstone{Hash: hash, Deleted: n.nextChange(hash)}
+	err := n.applyTombstone(stone)
+	if err != nil {
+		return err
+	}
+
+	for _, peerID := range n.knownPeers() {
+		go n.sendTombstonesToPeer(peerID, []tombstone{stone})
+	}
+	return nil
+}
+
+// restoreFile lifts the tombstone of a file that is uploaded again, here and
+// on every peer, before its shards are sent
+func (n *P2PNode) restoreFile(hash string) error {
+	n.shardMapMutex.RLock()
+	stone, ok := n.tombstones[hash]
+	n.shardMapMutex.RUnlock()
+	if !ok || !stone.deleted() || n.expired(stone) {
+		return nil
+	}
+
+	stone.Restored = n.nextChange(hash)
+	err := n.applyTombstone(stone)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, peerID := range n.knownPeers() {
+		wg.Add(1)
+		go func(pid peer.ID) {
+			defer wg.Done()
+			n.sendTombstonesToPeer(pid, []tombstone{stone})
+		}(peerID)
+	}
+	wg.Wait()
+	return nil
+}
+
+// nextChange returns the time to date a new change of a file's tombstone at.
+// It is later than the current one even when that is dated ahead of our
+// clock, so the new change wins.
+func (n *P2PNode) nextChange(hash string) time.Time {
+	now := time.Now().UTC()
+	n.shardMapMutex.RLock()
+	defer n.shardMapMutex.RUnlock()
+	if stone, ok := n.tombstones[hash]; ok && !now.After(stone.updated()) {
+		return stone.updated().Add(time.Millisecond)
+	}
+	return now
+}
+
+// expired reports whether a tombstone is older than Config.TombstoneTTL
+func (n *P2PNode) expired(stone tombstone) bool {
+	ttl := n.config.TombstoneTTL
+	return ttl > 0 && time.Since(stone.updated()) > ttl
+}
+
+// isDeleted reports whether a file has a live tombstone
+func (n *P2PNode) isDeleted(hash string) bool {
+	n.shardMapMutex.RLock()
+	defer n.shardMapMutex.RUnlock()
+	stone, ok := n.tombstones[hash]
+	return ok && stone.deleted() && !n.expired(stone)
+}
+
+// checkNotDeleted returns types.ErrFileDeleted for files with a tombstone
+func (n *P2PNode) checkNotDeleted(hash string) error {
+	if n.isDeleted(hash) {
+		return fmt.Errorf("%w: %s", types.ErrFileDeleted, hash)
+	}
+	return nil
+}
+
+// applyTombstone stores a tombstone newer than the one we hold and, when it
+// deletes its file, removes everything we hold of it. Older and expired
+// tombstones are ignored.
+func (n *P2PNode) applyTombstone(stone tombstone) error {
+	n.shardMapMutex.RLock()
+	current, ok := n.tombstones[stone.Hash]
+	n.shardMapMutex.RUnlock()
+	if n.expired(stone) || ok && !stone.updated().After(current.updated()) {
+		return nil
+	}
+	err := n.storeTombstone(stone)
+	if err != nil {
+		return err
+	}
+	if !stone.deleted() {
+		fmt.Printf("Restoring file %s\n", stone.Hash)
+		return nil
+	}
+	fmt.Printf("Deleting file %s\n", stone.Hash)
+	n.removeFile(stone.Hash)
+	return nil
+}
+
+// removeFile drops a file's shards, manifest and reconstructed copies.
+// Shard contents other files share are kept.
+func (n *P2PNode) removeFile(hash string) {
+	n.shardMapMutex.Lock()
+	shards := n.shardMap[hash]
+	n.recordShardChange(journalEntry{Op: journalDelete, File: hash})
+	delete(n.manifests, hash)
+	delete(n.verified, hash)
+	referenced := n.referencedKeys()
+	n.shardMapMutex.Unlock()
+	n.cache.remove(hash)
+
+	for _, shard := range shards {
+		key := sharding.ShardKey(shard)
+		if referenced[key] {
+			continue
+		}
+		err := n.shardStore().Delete(key)
+		if err != nil {
+			fmt.Printf("Failed to remove shard %s: %v\n", shard.Hash, err)
+		}
+	}
+
+	partials, _ := filepath.Glob(filepath.Join(n.destDir, hash+".*.partial"))
+	for _, path := range append([]string{
+		filepath.Join(n.manifestsDir, hash),
+		filepath.Join(n.destDir, hash),
+	}, partials...) {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Failed to remove %s: %v\n", path, err)
+		}
+	}
+}
+
+// tombstonesDir is where tombstones are persisted, one file per deleted file
+func (n *P2PNode) tombstonesDir() string {
+	return filepath.Join(n.config.DataDir, "tombstones")
+}
+
+// storeTombstone persists a tombstone and records it in memory
+func (n *P2PNode) storeTombstone(stone tombstone) error {
+	data, err := json.Marshal(stone)
+	if err != nil {
+		return fmt.Errorf("failed to encode tombstone: %v", err)
+	}
+	err = os.MkdirAll(n.tombstonesDir(), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create tombstones directory: %v", err)
+	}
+	path := filepath.Join(n.tombstonesDir(), stone.Hash)
+	err = os.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write tombstone: %v", err)
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return fmt.Errorf("failed to store tombstone: %v", err)
+	}
+
+	n.shardMapMutex.Lock()
+	n.tombstones[stone.Hash] = stone
+	n.shardMapMutex.Unlock()
+	return nil
+}
+
+// loadTombstones reads the persisted tombstones, drops expired ones and
+// finishes deletions a crash may have interrupted
+func (n *P2PNode) loadTombstones() error {
+	entries, err := os.ReadDir(n.tombstonesDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list tombstones: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(n.tombstonesDir(), entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read tombstone: %v", err)
+		}
+		var stone tombstone
+		err = json.Unmarshal(data, &stone)
+		if err != nil {
+			fmt.Printf("Ignoring bad tombstone %s: %v\n", entry.Name(), err)
+			continue
+		}
+		if n.expired(stone) {
+			os.Remove(filepath.Join(n.tombstonesDir(), entry.Name()))
+			continue
+		}
+		n.tombstones[stone.Hash] = stone
+		if _, held := n.shardMap[stone.Hash]; held && stone.deleted() {
+			n.removeFile(stone.Hash)
+		}
+	}
+	return nil
+}
+
+// allTombstones returns every tombstone we hold that hasn't expired
+func (n *P2PNode) allTombstones() []tombstone {
+	n.shardMapMutex.RLock()
+	defer n.shardMapMutex.RUnlock()
+	stones := make([]tombstone, 0, len(n.tombstones))
+	for _, stone := range n.tombstones {
+		if !n.expired(stone) {
+			stones = append(stones, stone)
+		}
+	}
+	return stones
+}
+
+// syncTombstones sends all our tombstones to a peer that just connected, so
+// it catches up on deletions it missed
+func (n *P2PNode) syncTombstones(peerID peer.ID) {
+	stones := n.allTombstones()
+	if len(stones) == 0 {
+		return
+	}
+	n.sendTombstonesToPeer(peerID, stones)
+}
+
+// sendTombstonesToPeer sends tombstones to a peer as a single JSON line
+func (n *P2PNode) sendTombstonesToPeer(peerID peer.ID, stones []tombstone) {
+	err := n.sendTombstones(peerID, stones)
+	if err != nil {
+		fmt.Printf("Failed to send tombstones to peer %s: %v\n", peerID, err)
+		return
+	}
+	fmt.Printf("Sent %d tombstones to peer %s\n", len(stones), peerID)
+}
+
+func (n *P2PNode) sendTombstones(peerID peer.ID, stones []tombstone) error {
+	data, err := json.Marshal(stones)
+	if err != nil {
+		return fmt.Errorf("failed to encode tombstones: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := n.host.NewStream(ctx, peerID, "/file/1.0.0")
+	if err != nil {
+		return fmt.Errorf("failed to create stream to peer %s: %v", peerID, err)
+	}
+	defer stream.Close()
+
+	_, err = stream.Write([]byte(requestTypeTombstones + " " + strconv.Itoa(len(stones)) + "\n"))
+	if err != nil {
+		return fmt.Errorf("failed to send tombstones request: %v", err)
+	}
+	_, err = stream.Write(append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to send tombstones: %v", err)
+	}
+
+	response, err := bufio.NewReader(stream).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+	if response = strings.TrimSpace(response); response != "OK" {
+		return fmt.Errorf("peer rejected tombstones: %s", response)
+	}
+	return nil
+}
+
+// handleTombstones applies the tombstones sent by a peer. Those for bad
+// hashes or dated ahead of our clock are ignored.
+func (n *P2PNode) handleTombstones(stream network.Stream, reader *bufio.Reader) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		fmt.Printf("Error reading tombstones: %v\n", err)
+		return
+	}
+
+	var stones []tombstone
+	err = json.Unmarshal(line, &stones)
+	if err != nil {
+		stream.Write([]byte("ERROR " + err.Error() + "\n"))
+		return
+	}
+	for _, stone := range stones {
+		if !sharding.ValidFileID(stone.Hash) {
+			fmt.Printf("Ignoring tombstone with bad hash %q\n", stone.Hash)
+			continue
+		}
+		if stone.updated().After(time.Now().Add(maxTombstoneSkew)) {
+			fmt.Printf("Ignoring tombstone of %s dated %s, ahead of our clock\n", stone.Hash, stone.updated())
+			continue
+		}
+		err = n.applyTombstone(stone)
+		if err != nil {
+			fmt.Printf("Failed to apply tombstone of %s: %v\n", stone.Hash, err)
+			stream.Write([]byte("ERROR " + err.Error() + "\n"))
+			return
+		}
+	}
+
+	_, err = stream.Write([]byte("OK\n"))
+	if err != nil {
+		fmt.Printf("Error sending OK response: %v\n", err)
+	}
+}
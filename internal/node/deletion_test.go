@@ -0,0 +1,166 @@
+package node
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"shard/internal/sharding"
+	"shard/internal/store"
+	"shard/internal/types"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTombstoneRemovesFile deletes one of two files sharing a shard through a
+// TOMBSTONES request and checks only what the other file doesn't need is gone,
+// and that the file stays deleted after a restart
+func TestTombstoneRemovesFile(t *testing.T) {
+	dataDir, manifestsDir, destDir := t.TempDir(), t.TempDir(), t.TempDir()
+	shards := store.NewMemStore()
+	node := restartNode(t, dataDir, manifestsDir, shards)
+	node.destDir = destDir
+
+	shared := make([]byte, sharding.ShardSize)
+	rand.Read(shared)
+	var hashes []string
+	for _, tail := range []string{"deleted", "kept"} {
+		content := append(append([]byte(nil), shared...), tail...)
+		hash := sharding.ContentDigest(content)
+		split, err := sharding.Split(bytes.NewReader(content), hash, shards, sharding.SplitOptions{})
+		if err != nil {
+			t.Fatalf("Split failed: %v", err)
+		}
+		err = node.storeManifest(sharding.NewManifest(hash, int64(len(content)), split))
+		if err != nil {
+			t.Fatalf("storeManifest failed: %v", err)
+		}
+		node.shardMapMutex.Lock()
+		node.recordShardChange(journalEntry{Op: journalAdd, File: hash, Shards: split})
+		node.shardMapMutex.Unlock()
+		hashes = append(hashes, hash)
+	}
+	deleted, kept := hashes[0], hashes[1]
+	err := os.WriteFile(filepath.Join(destDir, deleted), []byte("reconstructed"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write reconstructed file: %v", err)
+	}
+
+	stream := &mockStream{}
+	request := `[{"Hash":"` + deleted + `"}]` + "\n"
+	node.handleTombstones(stream, bufio.NewReader(strings.NewReader(request)))
+	if string(stream.writeBuffer) != "OK\n" {
+		t.Fatalf("Expected the tombstone to be accepted, got '%s'", string(stream.writeBuffer))
+	}
+
+	if node.getMaxShardIndex(deleted) != -1 {
+		t.Error("Deleted file is still in the shard map")
+	}
+	if keys, _ := shards.List(); len(keys) != 2 {
+		t.Errorf("Expected the shared shard and the kept tail to remain, got %d shards", len(keys))
+	}
+	if _, err := os.Stat(filepath.Join(destDir, deleted)); !os.IsNotExist(err) {
+		t.Error("Reconstructed copy was not removed")
+	}
+	if _, err := node.FileManifest(deleted); !errors.Is(err, types.ErrFileDeleted) {
+		t.Errorf("Expected ErrFileDeleted for the manifest, got %v", err)
+	}
+	if _, err := node.FileManifest(kept); err != nil {
+		t.Errorf("Manifest of the kept file is gone: %v", err)
+	}
+
+	// The file can't come back from a peer, nor after a restart
+	upload := &mockStream{}
+	node.handleFileUpload(upload, bufio.NewReader(strings.NewReader("{}\n")), deleted+".0")
+	if !strings.HasPrefix(string(upload.writeBuffer), "ERROR") {
+		t.Errorf("Expected a shard of a deleted file to be refused, got '%s'", string(upload.writeBuffer))
+	}
+	node = restartNode(t, dataDir, manifestsDir, shards)
+	if !node.isDeleted(deleted) || node.isDeleted(kept) {
+		t.Error("Tombstones did not survive a restart")
+	}
+}
+
+// TestDiscardKeepsSharedContents discards a shard whose contents another file
+// also uses and checks they are only deleted once no file lists them
+func TestDiscardKeepsSharedContents(t *testing.T) {
+	shards := store.NewMemStore()
+	node := restartNode(t, t.TempDir(), t.TempDir(), shards)
+
+	info, err := shards.Put("", strings.NewReader("shared contents"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	node.shardMapMutex.Lock()
+	for _, file := range []string{"first", "second"} {
+		shard := sharding.Shard{Index: 0, Hash: file + ".0", Digest: info.Key}
+		node.recordShardChange(journalEntry{Op: journalAdd, File: file, Shards: []sharding.Shard{shard}})
+	}
+	node.shardMapMutex.Unlock()
+
+	node.discardShards("first", []int{0})
+	if !shards.Has(info.Key) {
+		t.Fatal("Contents still listed by another file were deleted")
+	}
+	node.discardShards("second", []int{0})
+	if shards.Has(info.Key) {
+		t.Error("Contents no file lists were kept")
+	}
+}
+
+// TestRestoreDeletedFile uploads a deleted file again and checks older
+// tombstones from peers can't delete it again, while ones dated ahead of our
+// clock or past their TTL are ignored
+func TestRestoreDeletedFile(t *testing.T) {
+	dataDir, manifestsDir := t.TempDir(), t.TempDir()
+	node := restartNode(t, dataDir, manifestsDir, store.NewMemStore())
+	node.destDir = t.TempDir()
+	node.config.ShardSize = sharding.ShardSize
+	node.config.TombstoneTTL = time.Hour
+
+	content := []byte("a file deleted and uploaded again")
+	hash := sharding.ContentDigest(content)
+	err := node.DeleteFile(hash)
+	if err != nil {
+		t.Fatalf("DeleteFile failed: %v", err)
+	}
+	deleted := node.allTombstones()[0]
+	_, err = node.DistributeFile(hash, bytes.NewReader(content), types.UploadOptions{})
+	if err != nil {
+		t.Fatalf("Expected a deleted file to be uploaded again, got %v", err)
+	}
+	if node.isDeleted(hash) {
+		t.Fatal("File is still deleted after it was uploaded again")
+	}
+
+	send := func(stones string) {
+		stream := &mockStream{}
+		node.handleTombstones(stream, bufio.NewReader(strings.NewReader(stones+"\n")))
+		if string(stream.writeBuffer) != "OK\n" {
+			t.Fatalf("Expected the tombstones to be answered, got '%s'", string(stream.writeBuffer))
+		}
+	}
+	stale, _ := json.Marshal([]tombstone{deleted})
+	send(string(stale))
+	if node.isDeleted(hash) || node.getMaxShardIndex(hash) != 0 {
+		t.Error("A tombstone older than the upload deleted the file")
+	}
+
+	other := sharding.ContentDigest([]byte("another file"))
+	future, _ := json.Marshal([]tombstone{{Hash: other, Deleted: time.Now().Add(time.Hour)}})
+	expired, _ := json.Marshal([]tombstone{{Hash: other, Deleted: time.Now().Add(-2 * time.Hour)}})
+	send(string(future))
+	send(string(expired))
+	if node.isDeleted(other) {
+		t.Error("A tombstone dated ahead of our clock or past its TTL was applied")
+	}
+
+	node = restartNode(t, dataDir, manifestsDir, node.store)
+	if node.isDeleted(hash) {
+		t.Error("Restored file is deleted again after a restart")
+	}
+}
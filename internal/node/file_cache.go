@@ -0,0 +1,212 @@
+package node
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"shard/internal/sharding"
+	"shard/internal/types"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// fileCache keeps reconstructed files in destDir up to maxSize bytes,
+// evicting the least recently used ones. Evicted files are rebuilt from their
+// shards the next time they are asked for.
+type fileCache struct {
+	dir     string
+	maxSize int64 // zero is unlimited
+
+	mu      sync.Mutex
+	order   *list.List               // most recently used first
+	entries map[string]*list.Element // values are *cacheEntry
+	size    int64
+
+	hits, misses, evictions int64
+}
+
+type cacheEntry struct {
+	hash string
+	size int64
+}
+
+// newFileCache indexes the files already in dir, oldest first in line for
+// eviction, and drops the leftovers of interrupted reconstructions
+func newFileCache(dir string, maxSize int64) (*fileCache, error) {
+	if maxSize < 0 {
+		return nil, fmt.Errorf("cache size must not be negative, got %d", maxSize)
+	}
+	c := &fileCache{
+		dir:     dir,
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cached files: %v", err)
+	}
+
+	var cached []os.FileInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".partial") || strings.HasSuffix(name, ".plain") {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if key, err := sharding.ParseFileID(name); err != nil || key != name || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		cached = append(cached, info)
+	}
+	slices.SortFunc(cached, func(a, b os.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+	for _, info := range cached {
+		c.entries[info.Name()] = c.order.PushFront(&cacheEntry{hash: info.Name(), size: info.Size()})
+		c.size += info.Size()
+	}
+	c.evict("")
+	return c, nil
+}
+
+// open opens a cached file and marks it as the most recently used one
+func (c *fileCache) open(hash string) (*os.File, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[hash]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	file, err := os.Open(filepath.Join(c.dir, hash))
+	if err != nil {
+		// Removed behind our back
+		c.drop(element)
+		c.misses++
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	c.hits++
+	return file, true
+}
+
+// add caches a file just moved into dir and returns it opened, so it can be
+// served even if it is evicted right away
+func (c *fileCache) add(hash string) (*os.File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	file, err := os.Open(filepath.Join(c.dir, hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open reconstructed file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat reconstructed file: %v", err)
+	}
+
+	if element, ok := c.entries[hash]; ok {
+		c.drop(element)
+	}
+	c.entries[hash] = c.order.PushFront(&cacheEntry{hash: hash, size: info.Size()})
+	c.size += info.Size()
+	c.evict(hash)
+	return file, nil
+}
+
+// contains reports whether a file is cached, without counting as a use
+func (c *fileCache) contains(hash string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[hash]
+	return ok
+}
+
+// remove forgets a file whose copy was deleted. Nodes built without New
+// have no cache.
+func (c *fileCache) remove(hash string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[hash]; ok {
+		c.drop(element)
+	}
+}
+
+// evict removes least recently used files until the cache fits, keeping the
+// file named keep. The caller must hold mu.
+func (c *fileCache) evict(keep string) {
+	for c.maxSize > 0 && c.size > c.maxSize {
+		element := c.order.Back()
+		for element != nil && element.Value.(*cacheEntry).hash == keep {
+			element = element.Prev()
+		}
+		if element == nil {
+			return
+		}
+		entry := element.Value.(*cacheEntry)
+		err := os.Remove(filepath.Join(c.dir, entry.hash))
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Failed to evict %s: %v\n", entry.hash, err)
+			return
+		}
+		fmt.Printf("Evicted %s from the file cache\n", entry.hash)
+		c.drop(element)
+		c.evictions++
+	}
+}
+
+// drop forgets an entry. The caller must hold mu.
+func (c *fileCache) drop(element *list.Element) {
+	entry := c.order.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.hash)
+	c.size -= entry.size
+}
+
+// stats returns the cache's size and counters
+func (c *fileCache) stats() types.CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return types.CacheStats{
+		Files:     len(c.entries),
+		Size:      c.size,
+		MaxSize:   c.maxSize,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// OpenFile opens the reconstructed copy of a file, rebuilding it from its
+// shards when it isn't cached
+func (n *P2PNode) OpenFile(hash string) (*os.File, error) {
+	if file, ok := n.cache.open(hash); ok {
+		return file, nil
+	}
+	return n.reconstructFile(hash)
+}
+
+// IsCached reports whether a reconstructed copy of a file is at hand
+func (n *P2PNode) IsCached(hash string) bool {
+	return n.cache.contains(hash)
+}
+
+// CacheStats returns the state of the reconstructed file cache
+func (n *P2PNode) CacheStats() types.CacheStats {
+	return n.cache.stats()
+}
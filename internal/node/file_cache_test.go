@@ -0,0 +1,128 @@
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"shard/internal/sharding"
+	"shard/internal/store"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestFileCacheEviction fills a cache past its size and checks the least
+// recently used files are the ones evicted
+func TestFileCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string, age time.Duration) string {
+		hash := sharding.ContentDigest([]byte(content))
+		path := filepath.Join(dir, hash)
+		err := os.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write cached file: %v", err)
+		}
+		modified := time.Now().Add(-age)
+		os.Chtimes(path, modified, modified)
+		return hash
+	}
+
+	oldest := write("oldest 10b", 3*time.Hour)
+	older := write("older  10b", 2*time.Hour)
+	newest := write("newest 10b", time.Hour)
+	write("leftover", 0)
+	os.Rename(filepath.Join(dir, sharding.ContentDigest([]byte("leftover"))), filepath.Join(dir, "x.partial"))
+
+	cache, err := newFileCache(dir, 25)
+	if err != nil {
+		t.Fatalf("newFileCache failed: %v", err)
+	}
+	if cache.contains(oldest) || !cache.contains(older) || !cache.contains(newest) {
+		t.Error("Expected the oldest file to be evicted on startup")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "x.partial")); !os.IsNotExist(err) {
+		t.Error("Interrupted reconstruction was not removed")
+	}
+
+	// Using older makes newest the next one out
+	file, ok := cache.open(older)
+	if !ok {
+		t.Fatal("Expected a cache hit")
+	}
+	file.Close()
+
+	added := write("added  10b", 0)
+	file, err = cache.add(added)
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	file.Close()
+	if _, err := os.Stat(filepath.Join(dir, newest)); !os.IsNotExist(err) {
+		t.Error("Least recently used file was not evicted")
+	}
+	if !cache.contains(older) || !cache.contains(added) {
+		t.Error("Recently used files were evicted")
+	}
+
+	if _, ok := cache.open(newest); ok {
+		t.Error("Expected a miss for an evicted file")
+	}
+	stats := cache.stats()
+	if stats.Files != 2 || stats.Size != 20 || stats.Hits != 1 || stats.Misses != 1 || stats.Evictions != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+// TestConcurrentReconstruction asks for the same uncached file from several
+// requests at once and checks each one gets the whole file
+func TestConcurrentReconstruction(t *testing.T) {
+	shards := store.NewMemStore()
+	destDir := t.TempDir()
+	node := restartNode(t, t.TempDir(), t.TempDir(), shards)
+	node.destDir = destDir
+	cache, err := newFileCache(destDir, 0)
+	if err != nil {
+		t.Fatalf("newFileCache failed: %v", err)
+	}
+	node.cache = cache
+
+	content := make([]byte, 3*sharding.ShardSize)
+	rand.Read(content)
+	hash := sharding.ContentDigest(content)
+	split, err := sharding.Split(bytes.NewReader(content), hash, shards, sharding.SplitOptions{})
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	err = node.storeManifest(sharding.NewManifest(hash, int64(len(content)), split))
+	if err != nil {
+		t.Fatalf("storeManifest failed: %v", err)
+	}
+	node.shardMapMutex.Lock()
+	node.recordShardChange(journalEntry{Op: journalAdd, File: hash, Shards: split})
+	node.shardMapMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			file, err := node.reconstructFile(hash)
+			if err != nil {
+				t.Errorf("reconstructFile failed: %v", err)
+				return
+			}
+			defer file.Close()
+			data, _ := io.ReadAll(file)
+			if !bytes.Equal(data, content) {
+				t.Errorf("Reconstructed %d bytes, expected the %d of the file", len(data), len(content))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if partials, _ := filepath.Glob(filepath.Join(destDir, "*.partial")); len(partials) != 0 {
+		t.Errorf("Reconstructions left %v behind", partials)
+	}
+}
@@ -1,52 +1,176 @@
 package node
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"shard/internal/sharding"
+	"shard/internal/types"
+	"slices"
+	"sync"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
-func (n *P2PNode) DistributeFile(filePath string) {
+// DistributeFile splits the contents of r into shards named after name and
+// sends them to peers in the background. An empty name names the file after
+// the SHA-256 of its contents, hashed while they are split. It returns the
+// name of the file.
+func (n *P2PNode) DistributeFile(name string, r io.Reader, opts types.UploadOptions) (string, error) {
 	fmt.Println("Distributing file to peers")
-	fmt.Println("len(n.peerAddrs):", len(n.peerAddrs))
+	fmt.Println("len(n.peerAddrs):", len(n.knownPeers()))
+
+	shardSize := opts.ShardSize
+	if shardSize == 0 {
+		shardSize = n.config.ShardSize
+	}
+	splitOpts := sharding.SplitOptions{
+		Scheme: sharding.Scheme{
+			DataShards:   opts.DataShards,
+			ParityShards: opts.ParityShards,
+		},
+		ShardSize: shardSize,
+		Key:       opts.Key,
+		Workers:   n.config.Workers,
+	}
+	if opts.Chunker == types.ChunkerContentDefined {
+		splitOpts.Chunker = sharding.ContentDefinedChunker(shardSize)
+	}
+	if opts.Compression == types.CompressionZstd {
+		splitOpts.Codec = sharding.CodecZstd
+	}
 
 	// Split the file into shards
-	shards, err := sharding.SplitFile(filePath, n.shardsDir)
+	hash := sha256.New()
+	if name == "" {
+		r = io.TeeReader(r, hash)
+	}
+	counter := &countingReader{reader: r}
+	shards, err := sharding.Split(counter, name, n.shardStore(), splitOpts)
 	if err != nil {
-		fmt.Printf("Failed to split file: %v\n", err)
-		return
+		return "", fmt.Errorf("failed to split file: %v", err)
+	}
+	if name == "" {
+		name = hex.EncodeToString(hash.Sum(nil))
+		sharding.NameShards(shards, name)
 	}
 
-	// TODO: use shard manager
-	n.shardMapMutex.Lock()
-	// Store shard information
-	n.shardMap[filePath] = shards
-	n.shardMapMutex.Unlock()
-	
-	n.distributeShards(shards)
+	// Uploading a deleted file again brings it back
+	if err := n.restoreFile(name); err != nil {
+		return "", fmt.Errorf("failed to restore deleted file: %v", err)
+	}
+
+	manifest := sharding.NewManifest(name, counter.count, shards)
+	manifest.Filename = opts.Filename
+	manifest.ContentType = opts.ContentType
+	manifest.Codec = splitOpts.Codec
+	manifest.Updated = n.manifestTime(name)
+	// Store shard information, replacing that of an earlier upload
+	err = n.storeUpload(manifest, shards)
+	if err != nil {
+		return "", fmt.Errorf("failed to store manifest: %v", err)
+	}
+
+	replicas := opts.Replicas
+	if replicas == 0 {
+		replicas = n.config.Replicas
+	}
+	go func() {
+		n.replicateManifest(manifest)
+		n.placeShards(manifest, n.distributeShards(shards, replicas))
+	}()
+	return name, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	count  int64
 }
 
-func (n *P2PNode) distributeShards(shards []sharding.Shard) {
-	peerList := make([]peer.ID, 0, len(n.peerAddrs))
-	if len(n.peerAddrs) == 0 {
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// distributeShards sends every shard to replicas distinct peers and returns
+// the shards with the peers that took a copy
+func (n *P2PNode) distributeShards(shards []sharding.Shard, replicas int) []sharding.Shard {
+	peerList := n.knownPeers()
+	if len(peerList) == 0 {
 		fmt.Println("No peers available to distribute shards")
-		return
+		return nil
 	}
-	for peerID := range n.peerAddrs {
-		peerList = append(peerList, peerID)
+	if replicas < 1 {
+		replicas = 1
 	}
 
-	// Distribute each shard to different peers
+	// Each shard goes to the peers ranking highest for its name, which any
+	// node can work out again when retrieving it
+	placed := make([]sharding.Shard, len(shards))
+	var wg sync.WaitGroup
 	for i, shard := range shards {
-		peerIndex := i % len(peerList)
-		go func(s sharding.Shard, pid peer.ID) {
-			err := n.sendShardToPeer(s.Hash, pid)
-			if err != nil {
-				fmt.Printf("Failed to send shard to peer %s: %v\n", pid, err)
-				return
+		wg.Add(1)
+		go func(i int, s sharding.Shard) {
+			defer wg.Done()
+			s.Replicas = n.replicateShard(s, rankPeers(s.Hash, peerList), replicas)
+			placed[i] = s
+		}(i, shard)
+	}
+	wg.Wait()
+	return placed
+}
+
+// replicateShard sends a shard to peers in order until replicas of them hold
+// a copy, moving on when a peer is full or unreachable, and returns the IDs
+// of the peers that took it
+func (n *P2PNode) replicateShard(s sharding.Shard, ranked []peer.ID, replicas int) []string {
+	var holders []string
+	for _, pid := range ranked {
+		if len(holders) == replicas {
+			break
+		}
+		err := n.sendShardToPeer(s.Hash, pid)
+		if errors.Is(err, errPeerFull) {
+			fmt.Printf("Peer %s is full, trying another one for shard %d\n", pid, s.Index)
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Failed to send shard %d to peer %s: %v\n", s.Index, pid, err)
+			continue
+		}
+		fmt.Printf("Successfully sent shard %d to peer %s\n", s.Index, pid)
+		holders = append(holders, pid.String())
+	}
+	if len(holders) < replicas {
+		fmt.Printf("Shard %d is on %d of %d peers\n", s.Index, len(holders), replicas)
+	}
+	return holders
+}
+
+// placeShards records in the manifest which peers hold each shard and sends
+// it to peers again, so anyone retrieving the file asks those peers first
+func (n *P2PNode) placeShards(manifest sharding.Manifest, placed []sharding.Shard) {
+	if len(placed) == 0 {
+		return
+	}
+	shards := slices.Clone(manifest.Shards)
+	for _, shard := range placed {
+		for i := range shards {
+			if shards[i].Index == shard.Index {
+				shards[i].Replicas = shard.Replicas
 			}
-			fmt.Printf("Successfully sent shard %d to peer %s\n", s.Index, pid)
-		}(shard, peerList[peerIndex])
+		}
+	}
+	manifest.Shards = shards
+
+	err := n.storeManifest(manifest)
+	if err != nil {
+		fmt.Printf("Failed to record replicas of %s: %v\n", manifest.Hash, err)
+		return
 	}
+	n.replicateManifest(manifest)
 }
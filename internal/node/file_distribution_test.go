@@ -0,0 +1,137 @@
+package node
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"shard/internal/sharding"
+	"shard/internal/store"
+	"shard/internal/types"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// TestShardReplicasRecorded records where the shards of an upload went and
+// checks a node retrieving the file asks those replicas first, in order,
+// before any other peer
+func TestShardReplicasRecorded(t *testing.T) {
+	manifestsDir := t.TempDir()
+	uploader := restartNode(t, t.TempDir(), manifestsDir, store.NewMemStore())
+
+	content := strings.Repeat("replicated ", sharding.ShardSize/5)
+	hash := sharding.ContentDigest([]byte(content))
+	split, err := sharding.Split(strings.NewReader(content), hash, uploader.shardStore(), sharding.SplitOptions{})
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	manifest := sharding.NewManifest(hash, int64(len(content)), split)
+	err = uploader.storeManifest(manifest)
+	if err != nil {
+		t.Fatalf("storeManifest failed: %v", err)
+	}
+
+	var peers []peer.ID
+	for range 4 {
+		peers = append(peers, test.RandPeerIDFatal(t))
+	}
+	placed := make([]sharding.Shard, len(split))
+	copy(placed, split)
+	placed[1].Replicas = []string{peers[2].String(), peers[0].String()}
+	uploader.placeShards(manifest, placed)
+
+	recorded, _ := uploader.localManifest(hash)
+	if shard, _ := recorded.Shard(1); len(shard.Replicas) != 2 {
+		t.Fatalf("Expected the replicas of shard 1 in the manifest, got %v", shard.Replicas)
+	}
+
+	// A node that only knows the manifest
+	retriever := restartNode(t, t.TempDir(), manifestsDir, store.NewMemStore())
+	retriever.peerAddrs = make(map[peer.ID]multiaddr.Multiaddr)
+	for _, pid := range peers {
+		retriever.peerAddrs[pid] = nil
+	}
+	order := retriever.shardPeers(hash + ".1")
+	if len(order) != len(peers) || order[0] != peers[2] || order[1] != peers[0] {
+		t.Errorf("Expected replicas %s and %s to be asked first, got %v", peers[2], peers[0], order)
+	}
+	if order := retriever.shardPeers(hash + ".0"); !slices.Equal(order, rankPeers(hash+".0", peers)) {
+		t.Errorf("Expected peers to be asked in rendezvous order for a shard without replicas, got %v", order)
+	}
+}
+
+// TestReuploadReplacesShards uploads a file again with another shard size and
+// a key and checks the new shards replace the old ones, here, after a restart
+// and on a peer taking the new manifest
+func TestReuploadReplacesShards(t *testing.T) {
+	dataDir, manifestsDir := t.TempDir(), t.TempDir()
+	shards := store.NewMemStore()
+	node := restartNode(t, dataDir, manifestsDir, shards)
+	node.destDir = t.TempDir()
+
+	content := []byte(strings.Repeat("uploaded twice ", 300))
+	hash := sharding.ContentDigest(content)
+	// The first upload is named after its contents while it is split
+	name, err := node.DistributeFile("", bytes.NewReader(content), types.UploadOptions{ShardSize: 1024})
+	if err != nil {
+		t.Fatalf("DistributeFile failed: %v", err)
+	}
+	if name != hash {
+		t.Fatalf("Expected the upload to be named %s, got %s", hash, name)
+	}
+	first, _ := node.localManifest(hash)
+	if first.Shards[1].Hash != hash+".1" {
+		t.Errorf("Expected shards named after the file, got %s", first.Shards[1].Hash)
+	}
+
+	key, err := sharding.NewFileKey()
+	if err != nil {
+		t.Fatalf("NewFileKey failed: %v", err)
+	}
+	_, err = node.DistributeFile(hash, bytes.NewReader(content), types.UploadOptions{ShardSize: 2048, Key: key})
+	if err != nil {
+		t.Fatalf("Uploading again failed: %v", err)
+	}
+	second, _ := node.localManifest(hash)
+	if second.Root == first.Root || !second.Updated.After(first.Updated) {
+		t.Fatalf("Expected a newer manifest with another root")
+	}
+	for _, shard := range first.Shards {
+		if shards.Has(sharding.ShardKey(shard)) {
+			t.Errorf("Contents of shard %d of the first upload were kept", shard.Index)
+		}
+	}
+
+	node = restartNode(t, dataDir, manifestsDir, shards)
+	node.destDir = t.TempDir()
+	if node.merkleRoot(hash) != second.Root || len(node.shardIndexes(hash)) != second.ShardCount {
+		t.Fatalf("Expected the shards of the second upload after a restart, got %v", node.shardIndexes(hash))
+	}
+	err = node.retrieveFile(hash, "out.partial", key)
+	if err != nil {
+		t.Fatalf("retrieveFile failed: %v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(node.destDir, "out.partial"))
+	if !bytes.Equal(data, content) {
+		t.Errorf("Retrieved file does not match the original")
+	}
+
+	// A peer takes the newer manifest and keeps it over the older one
+	peer := restartNode(t, t.TempDir(), t.TempDir(), store.NewMemStore())
+	if err := peer.acceptManifest(first); err != nil {
+		t.Fatalf("acceptManifest failed: %v", err)
+	}
+	if err := peer.acceptManifest(second); err != nil {
+		t.Fatalf("Expected the newer manifest to be taken, got %v", err)
+	}
+	if err := peer.acceptManifest(first); err == nil {
+		t.Error("Expected the older manifest to be refused")
+	}
+	if peer.merkleRoot(hash) != second.Root {
+		t.Errorf("Expected the peer to know the root of the second upload")
+	}
+}
@@ -1,54 +1,250 @@
 package node
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"shard/internal/sharding"
+	"shard/internal/types"
+	"slices"
 	"strconv"
 	"sync"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
-// RequestFileFromPeers to handle shard reconstruction
+// maxMergeAttempts bounds how often corrupt shards are refetched
+const maxMergeAttempts = 3
+
+// RequestFileFromPeers to handle shard reconstruction. The merged file is only
+// moved into destDir once it hashes back to the requested hash.
 func (n *P2PNode) RequestFileFromPeers(hash string) error {
+	file, err := n.reconstructFile(hash)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// reconstructFile rebuilds a file into the cache and returns it opened.
+// Requests for the same file each merge into their own partial file, so
+// they don't overwrite one another.
+func (n *P2PNode) reconstructFile(hash string) (*os.File, error) {
+	err := os.MkdirAll(n.destDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+	temp, err := os.CreateTemp(n.destDir, hash+".*.partial")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	temp.Close()
+	defer os.Remove(temp.Name())
+
+	err = n.retrieveFile(hash, filepath.Base(temp.Name()), nil)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(temp.Name(), filepath.Join(n.destDir, hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to store reconstructed file: %v", err)
+	}
+	return n.cache.add(hash)
+}
+
+// DecryptFileFromPeers reconstructs an encrypted file with its key and copies
+// it to w. The plaintext only lives in a temporary file while it is verified
+// and copied, it is never kept in destDir.
+func (n *P2PNode) DecryptFileFromPeers(hash string, key []byte, w io.Writer) error {
+	err := os.MkdirAll(n.destDir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create output directory: %v", err)
+	}
+	temp, err := os.CreateTemp(n.destDir, hash+".*.plain")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	temp.Close()
+	defer os.Remove(temp.Name())
+
+	err = n.retrieveFile(hash, filepath.Base(temp.Name()), key)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(temp.Name())
+	if err != nil {
+		return fmt.Errorf("failed to open reconstructed file: %v", err)
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// retrieveFile fetches the shards of a file, merges them into partial inside
+// destDir and verifies the result, refetching corrupt shards along the way
+func (n *P2PNode) retrieveFile(hash string, partial string, key []byte) error {
+	if err := n.checkNotDeleted(hash); err != nil {
+		return err
+	}
 	fmt.Println("Requesting file from peers")
 	fmt.Println("Shard map before retrieval:")
 	n.printShardsMap()
-	err := n.missingShards(hash)
+
+	for attempt := 1; ; attempt++ {
+		local := n.shardIndexes(hash)
+		err := n.missingShards(hash)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve missing shards: %v", err)
+		}
+		// TODO: use shard manager
+		sortedShards := sharding.SortShards(n.fileShards(hash))
+		fmt.Println("sortedShards:", sortedShards)
+
+		// Merge shards back into the original file
+		err = sharding.MergeShards(sortedShards, n.destDir, n.shardStore(), partial, key)
+		var corrupt *sharding.CorruptShardsError
+		if errors.As(err, &corrupt) && attempt < maxMergeAttempts {
+			// Drop the bad copies so the next round fetches them from a peer
+			fmt.Printf("Refetching corrupt shards %v\n", corrupt.Indexes)
+			n.discardShards(hash, corrupt.Indexes)
+			continue
+		}
+		if err != nil {
+			os.Remove(filepath.Join(n.destDir, partial))
+			return fmt.Errorf("failed to merge shards: %w", err)
+		}
+
+		err = verifyFileDigest(filepath.Join(n.destDir, partial), hash)
+		if err == nil {
+			if info, err := os.Stat(filepath.Join(n.destDir, partial)); err == nil {
+				n.verifyManifest(hash, info.Size())
+			}
+			return nil
+		}
+		fmt.Printf("Reconstructed file failed verification: %v\n", err)
+		os.Remove(filepath.Join(n.destDir, partial))
+
+		// Shards fetched in this round are the suspects. With a Merkle root
+		// their digests were proven and checked while merging, so fetching
+		// them again can't help. Without one a digest only describes what
+		// the peer sent.
+		var fetched []int
+		for _, shard := range sortedShards {
+			if !slices.Contains(local, shard.Index) {
+				fetched = append(fetched, shard.Index)
+			}
+		}
+		if n.merkleRoot(hash) != "" || len(fetched) == 0 || attempt == maxMergeAttempts {
+			suspect := fetched
+			if len(suspect) == 0 {
+				suspect = n.shardIndexes(hash)
+			}
+			// The next request fetches them again rather than failing on
+			// the same copies
+			n.discardShards(hash, fetched)
+			return &types.IntegrityError{Hash: hash, Suspect: suspect}
+		}
+		fmt.Printf("Refetching unverified shards %v\n", fetched)
+		n.discardShards(hash, fetched)
+	}
+}
+
+// ReadFileRange writes length bytes of a file at offset to w, fetching only
+// the shards that cover them, and parity only when some of those are lost.
+// The file hash can't be checked for a range, shards are checked against the
+// digests of a verified manifest instead.
+func (n *P2PNode) ReadFileRange(hash string, key []byte, offset, length int64, w io.Writer) error {
+	if err := n.checkNotDeleted(hash); err != nil {
+		return err
+	}
+	manifest, ok := n.VerifiedManifest(hash)
+	if !ok {
+		return fmt.Errorf("no verified manifest of %s", hash)
+	}
+	first, last, skip, err := manifest.ShardRange(offset, length)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve missing shards: %v", err)
+		return err
 	}
-	// TODO: use shard manager
-	sortedShards := sharding.SortShards(n.shardMap[hash])
-	fmt.Println("sortedShards:", sortedShards)
+	covering := manifest.StripeShards(first, last)
+
+	var data, parity []int
+	for _, shard := range covering {
+		if shard.IsParity() {
+			parity = append(parity, shard.Index)
+		} else {
+			data = append(data, shard.Index)
+		}
+	}
+	n.fetchShards(hash, data)
+	held := n.shardIndexes(hash)
+	if slices.ContainsFunc(data, func(i int) bool { return !slices.Contains(held, i) }) {
+		n.fetchShards(hash, parity)
+		held = n.shardIndexes(hash)
+	}
+
+	// Shards are read as the verified manifest describes them, not as the
+	// peers that sent them did
+	var shards []sharding.Shard
+	for _, shard := range covering {
+		if slices.Contains(held, shard.Index) {
+			shards = append(shards, shard)
+		}
+	}
+
+	err = sharding.MergeRange(shards, n.shardStore(), key, first, skip, length, w)
+	var corrupt *sharding.CorruptShardsError
+	if errors.As(err, &corrupt) {
+		// The next request fetches them again
+		n.discardShards(hash, corrupt.Indexes)
+	}
+	return err
+}
 
-	// Merge shards back into the original file
-	err = sharding.MergeShards(sortedShards, n.destDir, n.shardsDir, hash)
+// verifyFileDigest checks that the file at path hashes to hash, a hex SHA-256
+// or a CID naming its own hash function
+func verifyFileDigest(path string, hash string) error {
+	verifier, err := sharding.NewFileVerifier(hash)
 	if err != nil {
-		return fmt.Errorf("failed to merge shards: %v", err)
+		return err
 	}
 
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open reconstructed file: %v", err)
+	}
+	defer file.Close()
+
+	_, err = io.Copy(verifier, file)
+	if err != nil {
+		return fmt.Errorf("failed to hash reconstructed file: %v", err)
+	}
+
+	if !verifier.Verify() {
+		return fmt.Errorf("reconstructed file hashes to %s", hex.EncodeToString(verifier.Sum(nil)))
+	}
 	return nil
 }
 
 func (n *P2PNode) missingShards(hash string) error {
 	// TODO: use shard manager
-	_, exists := n.shardMap[hash]
-	if !exists {
+	n.shardMapMutex.Lock()
+	if _, exists := n.shardMap[hash]; !exists {
 		// If we don't have shard information, initialize shard discovery
-		// TODO: use shard manager
 		fmt.Println("No shard info found, initializing empty entry and attempting discovery")
-		n.shardMapMutex.Lock()
 		n.shardMap[hash] = []sharding.Shard{}
-		n.shardMapMutex.Unlock()
 	} else {
 		fmt.Println("Shard info found, checking for missing shards")
 	}
+	n.shardMapMutex.Unlock()
 	n.requestMissingShards(hash)
 
 	// Verify we found at least one shard
 	// TODO: use shard manager
-	if len(n.shardMap[hash]) == 0 {
+	if len(n.fileShards(hash)) == 0 {
 		return fmt.Errorf("failed to find any shards for file %s", hash)
 	}
 	return nil
@@ -56,12 +252,32 @@ func (n *P2PNode) missingShards(hash string) error {
 
 func (n *P2PNode) requestMissingShards(hash string) {
 	fmt.Println("Requesting missing shards")
-	maxIndex, err := n.discoverMaxIndexOfHash(hash)
-	if err != nil {
-		fmt.Printf("Error discovering max index of hash %s: %v\n", hash, err)
-		return
+
+	// The manifest says exactly which shards exist, files uploaded without
+	// one fall back to asking peers for the highest index they hold
+	var maxIndex int
+	manifest, err := n.FileManifest(hash)
+	if err == nil {
+		maxIndex = manifest.ShardCount - 1
+	} else {
+		fmt.Printf("No manifest for %s: %v\n", hash, err)
+		maxIndex, err = n.discoverMaxIndexOfHash(hash)
+		if err != nil {
+			fmt.Printf("Error discovering max index of hash %s: %v\n", hash, err)
+			return
+		}
 	}
 
+	indexes := make([]int, maxIndex+1)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	n.fetchShards(hash, indexes)
+}
+
+// fetchShards requests the shards with the given indexes that we don't hold
+// yet from peers, in parallel
+func (n *P2PNode) fetchShards(hash string, indexes []int) {
 	var wg sync.WaitGroup
 	var processingWg sync.WaitGroup
 	shardChan := make(chan sharding.Shard)
@@ -70,9 +286,9 @@ func (n *P2PNode) requestMissingShards(hash string) {
 	// Start goroutine to collect results
 	go n.collectMissingShardsResults(&processingWg, shardChan, hash)
 
-	for i := range maxIndex + 1 {
-		// TODO: use shard manager
-		if hasShardIndex(n.shardMap[hash], i) {
+	held := n.shardIndexes(hash)
+	for _, i := range indexes {
+		if slices.Contains(held, i) {
 			fmt.Printf("Already have shard %d, skipping\n", i)
 			continue
 		}
@@ -91,11 +307,17 @@ func (n *P2PNode) requestMissingShards(hash string) {
 
 func (n *P2PNode) collectMissingShardsResults(processingWg *sync.WaitGroup, shardChan chan sharding.Shard, hash string) {
 	defer processingWg.Done()
+	var fetched []sharding.Shard
 	for shard := range shardChan {
-		n.shardMapMutex.Lock()
-		n.shardMap[hash] = append(n.shardMap[hash], shard)
-		n.shardMapMutex.Unlock()
+		fetched = append(fetched, shard)
+	}
+	if len(fetched) == 0 {
+		return
 	}
+	// One journal entry, synced once, records the whole fetch
+	n.shardMapMutex.Lock()
+	n.recordShardChange(journalEntry{Op: journalAdd, File: hash, Shards: fetched})
+	n.shardMapMutex.Unlock()
 }
 
 func (n *P2PNode) fetchShardAtIndex(wg *sync.WaitGroup, index int, hash string, shardChan chan sharding.Shard) {
@@ -114,7 +336,8 @@ func (n *P2PNode) discoverMaxIndexOfHash(shardHash string) (int, error) {
 	maxIndex := n.getMaxShardIndex(shardHash)
 
 	// check if we have any peers
-	if len(n.peerAddrs) == 0 {
+	peers := n.knownPeers()
+	if len(peers) == 0 {
 		fmt.Println("No peers available to request max index")
 		return maxIndex, nil
 	}
@@ -122,14 +345,15 @@ func (n *P2PNode) discoverMaxIndexOfHash(shardHash string) (int, error) {
 	var wg sync.WaitGroup
 	var processingWg sync.WaitGroup
 
-	indexChan := make(chan int)
+	indexChan := make(chan maxIndexResult)
+	rootVotes := make(map[string]int)
 
 	// Start a goroutine to process incoming indices
 	processingWg.Add(1)
-	go n.collectMaxIndexResults(&processingWg, indexChan, &maxIndex)
+	go n.collectMaxIndexResults(&processingWg, indexChan, &maxIndex, rootVotes)
 
 	// Start a goroutine for each peer
-	for peerID := range n.peerAddrs {
+	for _, peerID := range peers {
 		wg.Add(1)
 		go n.requestMaxIndexFromPeer(&wg, peerID, shardHash, indexChan)
 	}
@@ -141,6 +365,15 @@ func (n *P2PNode) discoverMaxIndexOfHash(shardHash string) (int, error) {
 	// Wait for the processing goroutine to finish
 	processingWg.Wait()
 
+	// Without a root of our own, trust the one most peers agree on
+	bestRoot := ""
+	for root, votes := range rootVotes {
+		if votes > rootVotes[bestRoot] {
+			bestRoot = root
+		}
+	}
+	n.learnMerkleRoot(shardHash, bestRoot)
+
 	if maxIndex == -1 {
 		fmt.Println("shard not found in any peer")
 		return -1, fmt.Errorf("shard not found in any peer")
@@ -150,34 +383,43 @@ func (n *P2PNode) discoverMaxIndexOfHash(shardHash string) (int, error) {
 	return maxIndex, nil
 }
 
-func (n *P2PNode) collectMaxIndexResults(processingWg *sync.WaitGroup, indexChan chan int, maxIndex *int) {
+// maxIndexResult is a peer's answer to a MAX_INDEX request
+type maxIndexResult struct {
+	index int
+	root  string
+}
+
+func (n *P2PNode) collectMaxIndexResults(processingWg *sync.WaitGroup, indexChan chan maxIndexResult, maxIndex *int, rootVotes map[string]int) {
 	defer processingWg.Done()
-	for index := range indexChan {
-		if index > *maxIndex {
-			fmt.Printf("Updating max index from %d to %d\n", *maxIndex, index)
-			*maxIndex = index
+	for result := range indexChan {
+		if result.index > *maxIndex {
+			fmt.Printf("Updating max index from %d to %d\n", *maxIndex, result.index)
+			*maxIndex = result.index
+		}
+		if result.root != "" {
+			rootVotes[result.root]++
 		}
 	}
 }
 
-func (n *P2PNode) requestMaxIndexFromPeer(wg *sync.WaitGroup, peerID peer.ID, shardHash string, indexChan chan int) {
+func (n *P2PNode) requestMaxIndexFromPeer(wg *sync.WaitGroup, peerID peer.ID, shardHash string, indexChan chan maxIndexResult) {
 	defer wg.Done()
 	fmt.Println("requesting max index from peer id", peerID)
 
-	index, err := n.requestMaxIndexOfShard(peerID, shardHash)
+	index, root, err := n.requestMaxIndexOfShard(peerID, shardHash)
 	if err != nil {
 		fmt.Printf("Peer %s couldn't provide shard's max index: %v\n", peerID, err)
 		return
 	}
 
 	fmt.Printf("Peer %s provided shard's max index: %d\n", peerID, index)
-	indexChan <- index
+	indexChan <- maxIndexResult{index: index, root: root}
 }
 
 func (n *P2PNode) requestSingleShard(shardHash string) (sharding.Shard, error) {
 	fmt.Println("Requesting shard", shardHash)
-	fmt.Println("peer ids known", n.peerAddrs)
-	for peerID := range n.peerAddrs {
+	fmt.Println("peer ids known", n.knownPeers())
+	for _, peerID := range n.shardPeers(shardHash) {
 		fmt.Println("requesting single shard from peer id", peerID)
 
 		shard, err := n.requestShardFromPeer(peerID, shardHash)
@@ -189,15 +431,36 @@ func (n *P2PNode) requestSingleShard(shardHash string) (sharding.Shard, error) {
 	return sharding.Shard{}, fmt.Errorf("shard not found in any peer")
 }
 
-func (n *P2PNode) createShardMetadata(shardPath string, size int64) (sharding.Shard, error) {
+// shardPeers returns the peers to ask for a shard: the replicas recorded in
+// the file's manifest first, in order, then every other known peer from the
+// likeliest holder down, as ranked at upload
+func (n *P2PNode) shardPeers(shardHash string) []peer.ID {
+	var peers []peer.ID
+	for _, id := range n.lookupShard(shardHash).Replicas {
+		pid, err := peer.Decode(id)
+		if err != nil || pid == n.ID || slices.Contains(peers, pid) {
+			continue
+		}
+		peers = append(peers, pid)
+	}
+	for _, peerID := range rankPeers(shardHash, n.knownPeers()) {
+		if !slices.Contains(peers, peerID) {
+			peers = append(peers, peerID)
+		}
+	}
+	return peers
+}
+
+func (n *P2PNode) createShardMetadata(shardPath string, size int64, header sharding.Shard) (sharding.Shard, error) {
 	index, err := sharding.ShardIndex(shardPath)
 	if err != nil {
 		return sharding.Shard{}, fmt.Errorf("failed to get shard index: %v", err)
 	}
 
-	return sharding.Shard{
-		Index: index,
-		Hash:  shardPath,
-		Size:  size,
-	}, nil
+	// Keep the scheme the peer sent, but trust our own view of the bytes
+	shard := header
+	shard.Index = index
+	shard.Hash = shardPath
+	shard.Size = size
+	return shard, nil
 }
@@ -0,0 +1,262 @@
+package node
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"shard/internal/sharding"
+	"shard/internal/store"
+	"shard/internal/types"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// fakePeer serves the shards of one file without a manifest or Merkle root,
+// flipping a byte of shard corrupt the first corruptions times it is sent.
+// With headers set it sends those, proofs included.
+type fakePeer struct {
+	host    host.Host
+	shards  [][]byte
+	headers []sharding.Shard
+
+	mu          sync.Mutex
+	corrupt     int
+	corruptions int
+	requests    map[int]int
+}
+
+func newFakePeer(t *testing.T, shards [][]byte) *fakePeer {
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatalf("Failed to create peer host: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+
+	p := &fakePeer{host: h, shards: shards, requests: make(map[int]int)}
+	h.SetStreamHandler("/file/1.0.0", p.handle)
+	return p
+}
+
+func (p *fakePeer) handle(stream network.Stream) {
+	defer stream.Close()
+	line, err := bufio.NewReader(stream).ReadString('\n')
+	if err != nil {
+		return
+	}
+	request, name, _ := strings.Cut(strings.TrimSpace(line), " ")
+	switch request {
+	case requestTypeMaxIndex:
+		stream.Write([]byte("OK\n" + strconv.Itoa(len(p.shards)-1) + "\n\n"))
+	case requestTypeGet:
+		_, index, ok := parseShardName(name)
+		if !ok || index >= len(p.shards) {
+			stream.Write([]byte("NOT FOUND\n"))
+			return
+		}
+		p.mu.Lock()
+		p.requests[index]++
+		contents := slices.Clone(p.shards[index])
+		if index == p.corrupt && p.corruptions > 0 {
+			p.corruptions--
+			contents[0] ^= 0xff
+		}
+		p.mu.Unlock()
+
+		header := sharding.Shard{Hash: name, Index: index}
+		if p.headers != nil {
+			header = p.headers[index]
+		}
+		stream.Write([]byte("OK\n"))
+		writeShardHeader(stream, shardHeader{Shard: header})
+		stream.Write(contents)
+	default:
+		stream.Write([]byte("NOT FOUND\n"))
+	}
+}
+
+// retrievalNode returns a node with no shards whose only peer is remote
+func retrievalNode(t *testing.T, remote *fakePeer) *P2PNode {
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatalf("Failed to create node host: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+	h.Peerstore().AddAddrs(remote.host.ID(), remote.host.Addrs(), peerstore.PermanentAddrTTL)
+
+	node := restartNode(t, t.TempDir(), t.TempDir(), store.NewMemStore())
+	node.host, node.ID = h, h.ID()
+	node.destDir = t.TempDir()
+	node.peerAddrs = map[peer.ID]multiaddr.Multiaddr{remote.host.ID(): remote.host.Addrs()[0]}
+	return node
+}
+
+// TestRetrieveCorruptShard fetches a file whose shards carry no digest from a
+// peer serving one of them corrupted. A single bad copy is fetched again and
+// the file repaired, a peer that keeps sending it fails the file with every
+// fetched shard as a suspect.
+func TestRetrieveCorruptShard(t *testing.T) {
+	content := []byte(strings.Repeat("shard retrieval test data ", 120))
+	hash := sharding.ContentDigest(content)
+	third := len(content) / 3
+	shards := [][]byte{content[:third], content[third : 2*third], content[2*third:]}
+
+	remote := newFakePeer(t, shards)
+	remote.corrupt, remote.corruptions = 1, 1
+	node := retrievalNode(t, remote)
+	err := node.retrieveFile(hash, "out.partial", nil)
+	if err != nil {
+		t.Fatalf("retrieveFile failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(node.destDir, "out.partial"))
+	if err != nil {
+		t.Fatalf("Failed to read retrieved file: %v", err)
+	}
+	if string(data) != string(content) {
+		t.Errorf("Retrieved file does not match the original")
+	}
+	if got := remote.requests[1]; got != 2 {
+		t.Errorf("Expected the corrupt shard to be fetched twice, got %d", got)
+	}
+	// A fetch, the discard of the corrupt shard and its refetch
+	if node.journal.entries != 3 {
+		t.Errorf("Expected each fetch to be journaled at once, got %d entries", node.journal.entries)
+	}
+
+	remote = newFakePeer(t, shards)
+	remote.corrupt, remote.corruptions = 1, maxMergeAttempts
+	node = retrievalNode(t, remote)
+	err = node.retrieveFile(hash, "out.partial", nil)
+	var integrity *types.IntegrityError
+	if !errors.As(err, &integrity) {
+		t.Fatalf("Expected an integrity error, got %v", err)
+	}
+	if !slices.Equal(integrity.Suspect, []int{0, 1, 2}) {
+		t.Errorf("Expected every fetched shard to be suspect, got %v", integrity.Suspect)
+	}
+	if got := remote.requests[1]; got != maxMergeAttempts {
+		t.Errorf("Expected the corrupt shard to be fetched %d times, got %d", maxMergeAttempts, got)
+	}
+	if _, err := os.Stat(filepath.Join(node.destDir, "out.partial")); !os.IsNotExist(err) {
+		t.Errorf("Expected the failed partial file to be removed, got %v", err)
+	}
+}
+
+// TestRetrieveKnownRootDiscardsSuspects fetches shards proving against the
+// file's Merkle root that don't rebuild a file with its hash, and checks the
+// suspects are dropped so the next request fetches them again
+func TestRetrieveKnownRootDiscardsSuspects(t *testing.T) {
+	content := []byte(strings.Repeat("proven but wrong ", 150))
+	hash := sharding.ContentDigest([]byte("another file"))
+	split, err := sharding.Split(bytes.NewReader(content), hash, store.NewMemStore(), sharding.SplitOptions{ShardSize: 1024})
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	var shards [][]byte
+	for start := 0; start < len(content); start += 1024 {
+		shards = append(shards, content[start:min(start+1024, len(content))])
+	}
+
+	remote := newFakePeer(t, shards)
+	remote.headers = split
+	node := retrievalNode(t, remote)
+	err = node.acceptManifest(sharding.NewManifest(hash, int64(len(content)), split))
+	if err != nil {
+		t.Fatalf("acceptManifest failed: %v", err)
+	}
+	err = node.retrieveFile(hash, "out.partial", nil)
+	var integrity *types.IntegrityError
+	if !errors.As(err, &integrity) || len(integrity.Suspect) != len(split) {
+		t.Fatalf("Expected every shard to be suspect, got %v", err)
+	}
+	if held := node.shardIndexes(hash); len(held) != 0 {
+		t.Errorf("Expected the suspect shards to be discarded, still holding %v", held)
+	}
+}
+
+// TestPeerManifestTrust checks a manifest from a peer can't replace one with
+// another root and is only trusted for range reads once the file was rebuilt
+// from it, after which peers can't change it
+func TestPeerManifestTrust(t *testing.T) {
+	shards := store.NewMemStore()
+	node := restartNode(t, t.TempDir(), t.TempDir(), shards)
+	node.destDir = t.TempDir()
+
+	content := []byte(strings.Repeat("manifest trust test data ", 200))
+	hash := sharding.ContentDigest(content)
+	split, err := sharding.Split(bytes.NewReader(content), hash, shards, sharding.SplitOptions{ShardSize: 1024})
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	manifest := sharding.NewManifest(hash, int64(len(content)), split)
+	err = node.acceptManifest(manifest)
+	if err != nil {
+		t.Fatalf("acceptManifest failed: %v", err)
+	}
+	if _, ok := node.VerifiedManifest(hash); ok {
+		t.Errorf("Expected a peer's manifest not to be trusted before the file was rebuilt")
+	}
+	if err := node.ReadFileRange(hash, nil, 0, 10, io.Discard); err == nil {
+		t.Errorf("Expected a range read from an unverified manifest to fail")
+	}
+
+	forged := sharding.NewManifest(hash, int64(len(content)), split[:1])
+	if err := node.acceptManifest(forged); err == nil || !strings.Contains(err.Error(), "conflicts") {
+		t.Errorf("Expected a manifest with another root to be refused")
+	}
+	if held, _ := node.localManifest(hash); held.Root != manifest.Root {
+		t.Errorf("Expected the held manifest to be kept, got root %s", held.Root)
+	}
+
+	node.shardMapMutex.Lock()
+	node.recordShardChange(journalEntry{Op: journalAdd, File: hash, Shards: split})
+	node.shardMapMutex.Unlock()
+	err = node.retrieveFile(hash, "out.partial", nil)
+	if err != nil {
+		t.Fatalf("retrieveFile failed: %v", err)
+	}
+	if _, ok := node.VerifiedManifest(hash); !ok {
+		t.Fatalf("Expected the manifest to be trusted once the file was rebuilt")
+	}
+	var out bytes.Buffer
+	err = node.ReadFileRange(hash, nil, 1500, 100, &out)
+	if err != nil {
+		t.Fatalf("ReadFileRange failed: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), content[1500:1600]) {
+		t.Errorf("Range read returned the wrong bytes")
+	}
+
+	// Range reads follow the verified manifest, not what peers said of the
+	// shards they sent, and a copy of it with other metadata is refused
+	node.shardMapMutex.Lock()
+	for i := range node.shardMap[hash] {
+		node.shardMap[hash][i].Codec = sharding.CodecZstd
+	}
+	node.shardMapMutex.Unlock()
+	out.Reset()
+	err = node.ReadFileRange(hash, nil, 1500, 100, &out)
+	if err != nil || !bytes.Equal(out.Bytes(), content[1500:1600]) {
+		t.Errorf("Range read used the shard map's metadata: %v", err)
+	}
+	resized := manifest
+	resized.Size = 10
+	if err := node.acceptManifest(resized); err == nil {
+		t.Error("Expected a copy of the verified manifest with another size to be refused")
+	}
+	if held, _ := node.VerifiedManifest(hash); held.Size != int64(len(content)) {
+		t.Errorf("Verified manifest was replaced, size %d", held.Size)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"shard/internal/sharding"
+	"shard/internal/store"
 	"testing"
 	"time"
 )
@@ -29,17 +31,23 @@ func TestShardTransfer(t *testing.T) {
 	defer os.RemoveAll(node2Dir)
 
 	// Create the nodes
-	node1, err := New(node1Dir)
+	config1 := DefaultConfig()
+	config1.DataDir = filepath.Join(node1Dir, "data")
+	node1, err := NewWithConfig(node1Dir, config1)
 	if err != nil {
 		t.Fatalf("Failed to create node1: %v", err)
 	}
 	defer node1.Close()
 
-	node2, err := New(node2Dir)
+	config2 := DefaultConfig()
+	config2.DataDir = filepath.Join(node2Dir, "data")
+	node2, err := NewWithConfig(node2Dir, config2)
 	if err != nil {
 		t.Fatalf("Failed to create node2: %v", err)
 	}
 	defer node2.Close()
+	node2.shardsDir = filepath.Join(node2Dir, "shards")
+	node2.store = store.NewFSStore(node2.shardsDir)
 
 	// Wait for peer discovery and connection
 	fmt.Println("Waiting for peer discovery...")
@@ -49,16 +57,21 @@ func TestShardTransfer(t *testing.T) {
 	}
 	fmt.Println("Nodes connected successfully")
 
-	// Create a test file in node1's directory
+	// Create a test file in node1's shards directory
 	testFileName := "testfile.txt"
 	testContent := "This is a test file for P2P transfer"
-	err = os.WriteFile(testFileName, []byte(testContent), 0644)
+	err = os.MkdirAll(node1.shardsDir, 0755)
+	if err != nil {
+		t.Fatalf("Failed to create shards dir: %v", err)
+	}
+	testFilePath := filepath.Join(node1.shardsDir, testFileName)
+	err = os.WriteFile(testFilePath, []byte(testContent), 0644)
 	if err != nil {
 		t.Fatalf("Failed to create test file: %v", err)
 	}
 
-	fmt.Println("wrote to testFileName", testFileName)
-	defer os.RemoveAll(testFileName)
+	fmt.Println("wrote to testFileName", testFilePath)
+	defer os.RemoveAll(testFilePath)
 
 	if !node1.IsPeerConnected(node2.ID) {
 		t.Fatalf("Connection to peer lost before file transfer")
@@ -73,8 +86,8 @@ func TestShardTransfer(t *testing.T) {
 	// Wait for file transfer to complete
 	time.Sleep(1 * time.Second)
 
-	// Verify file was received by node2
-	receivedFilePath := filepath.Join(node2.shardsDir, testFileName)
+	// Verify file was received by node2, stored under its digest
+	receivedFilePath := store.NewFSStore(node2.shardsDir).Path(sharding.ContentDigest([]byte(testContent)))
 	fmt.Println("receivedfilepath", receivedFilePath)
 	receivedContent, err := os.ReadFile(receivedFilePath)
 	if err != nil {
@@ -0,0 +1,281 @@
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"shard/internal/sharding"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// FileManifest returns the manifest of a file, asking peers for it when we
+// don't hold it ourselves
+func (n *P2PNode) FileManifest(hash string) (sharding.Manifest, error) {
+	if !sharding.ValidFileID(hash) {
+		return sharding.Manifest{}, fmt.Errorf("invalid file hash %q", hash)
+	}
+	if err := n.checkNotDeleted(hash); err != nil {
+		return sharding.Manifest{}, err
+	}
+	if manifest, ok := n.localManifest(hash); ok {
+		return manifest, nil
+	}
+
+	for _, peerID := range rankPeers(hash, n.knownPeers()) {
+		manifest, err := n.requestManifestFromPeer(peerID, hash)
+		if err != nil {
+			fmt.Printf("Peer %s couldn't provide manifest: %v\n", peerID, err)
+			continue
+		}
+		if manifest.Hash != hash {
+			fmt.Printf("Peer %s sent the manifest of %s\n", peerID, manifest.Hash)
+			continue
+		}
+		err = n.acceptManifest(manifest)
+		if err != nil {
+			return sharding.Manifest{}, err
+		}
+		return manifest, nil
+	}
+	return sharding.Manifest{}, fmt.Errorf("manifest of %s not found in any peer", hash)
+}
+
+// localManifest returns the manifest of a file if we hold it
+func (n *P2PNode) localManifest(hash string) (sharding.Manifest, bool) {
+	if !sharding.ValidFileID(hash) {
+		return sharding.Manifest{}, false
+	}
+	n.shardMapMutex.RLock()
+	manifest, ok := n.manifests[hash]
+	n.shardMapMutex.RUnlock()
+	if ok {
+		return manifest, true
+	}
+
+	data, err := os.ReadFile(filepath.Join(n.manifestsDir, hash))
+	if err != nil {
+		return sharding.Manifest{}, false
+	}
+	manifest, err = sharding.DecodeManifest(data)
+	if err != nil {
+		fmt.Printf("Ignoring stored manifest of %s: %v\n", hash, err)
+		return sharding.Manifest{}, false
+	}
+
+	n.shardMapMutex.Lock()
+	n.manifests[hash] = manifest
+	n.shardMapMutex.Unlock()
+	return manifest, true
+}
+
+// maxManifestSkew is how far ahead of our clock a peer's manifest may be
+// dated. One from further ahead would win over every later upload.
+const maxManifestSkew = 5 * time.Minute
+
+// storeManifest stores a manifest we built ourselves, which range reads can
+// trust right away
+func (n *P2PNode) storeManifest(manifest sharding.Manifest) error {
+	return n.storeUpload(manifest, nil)
+}
+
+// storeUpload stores the manifest of a file we split along with the shards
+// the split stored. They replace the shards of an earlier upload of the file
+// in one step.
+func (n *P2PNode) storeUpload(manifest sharding.Manifest, shards []sharding.Shard) error {
+	n.manifestLock.Lock()
+	defer n.manifestLock.Unlock()
+	err := n.writeManifest(manifest)
+	if err != nil {
+		return err
+	}
+	n.adoptManifest(manifest, shards)
+	n.shardMapMutex.Lock()
+	n.verified[manifest.Hash] = true
+	n.shardMapMutex.Unlock()
+	return nil
+}
+
+// acceptManifest stores a manifest sent by a peer. One describing other
+// shards than the manifest held only replaces it when it was updated later.
+// A verified manifest is never replaced by a copy with the same root, whose
+// other fields the root doesn't cover. Range reads only trust the manifest
+// once the file was rebuilt from it and hashed back to its name.
+func (n *P2PNode) acceptManifest(manifest sharding.Manifest) error {
+	n.manifestLock.Lock()
+	defer n.manifestLock.Unlock()
+	if manifest.Updated.After(time.Now().Add(maxManifestSkew)) {
+		return fmt.Errorf("manifest of %s is dated %s, ahead of our clock", manifest.Hash, manifest.Updated)
+	}
+	if current, ok := n.localManifest(manifest.Hash); ok {
+		if current.Root != manifest.Root && !manifest.Updated.After(current.Updated) {
+			return fmt.Errorf("manifest conflicts with the one held for %s, whose root is %s", manifest.Hash, current.Root)
+		}
+		if _, verified := n.VerifiedManifest(manifest.Hash); verified && current.Root == manifest.Root {
+			if !sameManifest(current, manifest) {
+				return fmt.Errorf("manifest differs from the verified one held for %s", manifest.Hash)
+			}
+			return nil
+		}
+	}
+	err := n.writeManifest(manifest)
+	if err != nil {
+		return err
+	}
+	n.adoptManifest(manifest, nil)
+	n.shardMapMutex.Lock()
+	delete(n.verified, manifest.Hash)
+	n.shardMapMutex.Unlock()
+	return nil
+}
+
+// sameManifest reports whether two manifests encode to the same bytes
+func sameManifest(a, b sharding.Manifest) bool {
+	encodedA, errA := a.Encode()
+	encodedB, errB := b.Encode()
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
+
+// manifestTime returns the time to date a new upload of a file at. It is
+// later than the manifest held, even when that is dated ahead of our clock,
+// so the new upload wins.
+func (n *P2PNode) manifestTime(hash string) time.Time {
+	now := time.Now().UTC()
+	if current, ok := n.localManifest(hash); ok && !now.After(current.Updated) {
+		return current.Updated.Add(time.Millisecond)
+	}
+	return now
+}
+
+// adoptManifest makes the shard map follow the manifest of a file, adding
+// the given shards stored for it. When the manifest has another root than the
+// one known, the file's shards and root are replaced in one step, keeping the
+// held shards the manifest lists, and contents nothing uses any more are
+// deleted. The caller must hold manifestLock.
+func (n *P2PNode) adoptManifest(manifest sharding.Manifest, shards []sharding.Shard) {
+	n.shardMapMutex.Lock()
+	defer n.shardMapMutex.Unlock()
+	root, known := n.merkleRoots[manifest.Hash]
+	if !known || root == manifest.Root {
+		if !known {
+			n.recordShardChange(journalEntry{Op: journalRoot, File: manifest.Hash, Root: manifest.Root})
+		}
+		if len(shards) > 0 {
+			n.recordShardChange(journalEntry{Op: journalAdd, File: manifest.Hash, Shards: shards})
+		}
+		return
+	}
+
+	var kept, dropped []sharding.Shard
+	for _, shard := range append(slices.Clone(shards), n.shardMap[manifest.Hash]...) {
+		listed, ok := manifest.Shard(shard.Index)
+		if ok && listed.Digest == shard.Digest && !hasShardIndex(kept, shard.Index) {
+			kept = append(kept, shard)
+		} else {
+			dropped = append(dropped, shard)
+		}
+	}
+	n.recordShardChange(journalEntry{Op: journalReplace, File: manifest.Hash, Shards: kept, Root: manifest.Root})
+	fmt.Printf("Replaced the shards of %s with those of root %s\n", manifest.Hash, manifest.Root)
+
+	referenced := n.referencedKeys()
+	for _, shard := range dropped {
+		if referenced[sharding.ShardKey(shard)] {
+			continue
+		}
+		err := n.shardStore().Delete(sharding.ShardKey(shard))
+		if err != nil {
+			fmt.Printf("Failed to remove shard %s: %v\n", shard.Hash, err)
+		}
+	}
+}
+
+// writeManifest validates a manifest and writes it to manifestsDir. The
+// caller must hold manifestLock.
+func (n *P2PNode) writeManifest(manifest sharding.Manifest) error {
+	if err := n.checkNotDeleted(manifest.Hash); err != nil {
+		return err
+	}
+	if err := manifest.Validate(); err != nil {
+		return err
+	}
+	data, err := manifest.Encode()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(n.manifestsDir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create manifests directory: %v", err)
+	}
+	path := filepath.Join(n.manifestsDir, manifest.Hash)
+	err = os.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return fmt.Errorf("failed to store manifest: %v", err)
+	}
+
+	n.shardMapMutex.Lock()
+	n.manifests[manifest.Hash] = manifest
+	n.shardMapMutex.Unlock()
+	return nil
+}
+
+// VerifiedManifest returns the manifest of a file when range reads can trust
+// it: we built it, or rebuilt the file from shards matching it
+func (n *P2PNode) VerifiedManifest(hash string) (sharding.Manifest, bool) {
+	if n.isDeleted(hash) {
+		return sharding.Manifest{}, false
+	}
+	manifest, ok := n.localManifest(hash)
+	n.shardMapMutex.RLock()
+	defer n.shardMapMutex.RUnlock()
+	return manifest, ok && n.verified[hash]
+}
+
+// verifyManifest trusts the manifest of a file that was rebuilt to size bytes
+// and hashed back to its name, when every shard it lists is held with the
+// digest it records
+func (n *P2PNode) verifyManifest(hash string, size int64) {
+	manifest, ok := n.localManifest(hash)
+	if !ok || manifest.Size != size {
+		return
+	}
+	n.shardMapMutex.Lock()
+	defer n.shardMapMutex.Unlock()
+	for _, shard := range manifest.Shards {
+		matches := func(held sharding.Shard) bool {
+			return held.Index == shard.Index && held.Digest == shard.Digest
+		}
+		if !slices.ContainsFunc(n.shardMap[hash], matches) {
+			return
+		}
+	}
+	n.verified[hash] = true
+}
+
+// replicateManifest sends a manifest to every known peer and waits for them
+// to answer
+func (n *P2PNode) replicateManifest(manifest sharding.Manifest) {
+	var wg sync.WaitGroup
+	for _, peerID := range n.knownPeers() {
+		wg.Add(1)
+		go func(pid peer.ID) {
+			defer wg.Done()
+			err := n.sendManifestToPeer(manifest, pid)
+			if err != nil {
+				fmt.Printf("Failed to send manifest to peer %s: %v\n", pid, err)
+				return
+			}
+			fmt.Printf("Successfully sent manifest of %s to peer %s\n", manifest.Hash, pid)
+		}(peerID)
+	}
+	wg.Wait()
+}
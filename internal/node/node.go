@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"shard/internal/sharding"
+	"shard/internal/store"
 	"sync"
 	"time"
 
@@ -27,19 +28,144 @@ type P2PNode struct {
 	peerAddrs map[peer.ID]multiaddr.Multiaddr
 	peerLock  sync.Mutex
 
-	shardsDir     string // Where shards are stored
+	config Config
+
+	shardsDir     string              // Where shards are stored by default
+	store         store.ShardStore    // Holds shard contents
+	limits        *store.LimitedStore // Tracks store usage, nil is unlimited
+	journal       *shardJournal       // Persists shardMap, nil keeps it in memory only
+	manifestsDir  string              // Where file manifests are stored
 	shardMap      map[string][]sharding.Shard
+	merkleRoots   map[string]string // Merkle root of each file's shards
+	manifests     map[string]sharding.Manifest
+	verified      map[string]bool      // Files whose manifest range reads trust
+	manifestLock  sync.Mutex           // Serializes manifest writes
+	tombstones    map[string]tombstone // Files deleted from the network
+	cache         *fileCache           // Reconstructed files in destDir
+	scrubber      scrubber
+	compactStop   chan struct{} // Stops background compaction
 	shardMapMutex sync.RWMutex
 }
 
-// New creates a new P2P node
+// Config holds the node settings that can be tuned at startup
+type Config struct {
+	// ShardSize is used for uploads that don't pick their own shard size
+	ShardSize int64
+	// Store holds shard contents. When nil, Backend picks how they are kept
+	// in shardsDir: "fs", the default, keeps a file per shard and "pack"
+	// appends them to segment files.
+	Store   store.ShardStore
+	Backend string
+	// DataDir is where the shard map is persisted
+	DataDir string
+	// Capacity is how many bytes of shards the node holds at most, zero is
+	// unlimited
+	Capacity int64
+	// CacheSize is how many bytes of reconstructed files are kept in
+	// destDir, zero is unlimited
+	CacheSize int64
+	// ScrubInterval is how often stored shards are re-hashed, zero disables
+	// scrubbing. ScrubRate caps how many bytes per second a scrub reads,
+	// zero is unlimited.
+	ScrubInterval time.Duration
+	ScrubRate     int64
+	// Replicas is how many distinct peers each shard is sent to, for uploads
+	// that don't pick their own
+	Replicas int
+	// CompactInterval is how often stores that keep deleted contents around
+	// reclaim their space, zero disables compaction
+	CompactInterval time.Duration
+	// TombstoneTTL is how long a deleted file is kept from coming back from
+	// peers that still hold it, zero keeps tombstones for good
+	TombstoneTTL time.Duration
+	// Workers is how many stripes of an upload are written in parallel,
+	// zero uses every CPU
+	Workers int
+}
+
+// DefaultConfig returns the settings New uses
+func DefaultConfig() Config {
+	return Config{
+		ShardSize:       sharding.ShardSize,
+		DataDir:         "data",
+		CacheSize:       1 << 30,
+		ScrubInterval:   24 * time.Hour,
+		ScrubRate:       8 << 20,
+		CompactInterval: time.Hour,
+		TombstoneTTL:    30 * 24 * time.Hour,
+		Replicas:        1,
+	}
+}
+
+// New creates a new P2P node with the default config
 func New(destDir string) (*P2PNode, error) {
+	return NewWithConfig(destDir, DefaultConfig())
+}
+
+// NewWithConfig creates a new P2P node
+func NewWithConfig(destDir string, config Config) (*P2PNode, error) {
+	if err := sharding.ValidateShardSize(config.ShardSize); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	if config.Replicas < 0 {
+		return nil, fmt.Errorf("invalid config: replicas must not be negative, got %d", config.Replicas)
+	}
+	if config.Workers < 0 {
+		return nil, fmt.Errorf("invalid config: workers must not be negative, got %d", config.Workers)
+	}
+
 	node := P2PNode{
-		peerAddrs: make(map[peer.ID]multiaddr.Multiaddr),
-		shardsDir: "shards", // TODO: make this configurable
-		destDir:   destDir,
-		shardMap:  make(map[string][]sharding.Shard),
-		connected: make(map[peer.ID]bool),
+		config:       config,
+		peerAddrs:    make(map[peer.ID]multiaddr.Multiaddr),
+		shardsDir:    "shards", // TODO: make this configurable
+		store:        config.Store,
+		manifestsDir: "manifests",
+		destDir:      destDir,
+		shardMap:     make(map[string][]sharding.Shard),
+		merkleRoots:  make(map[string]string),
+		manifests:    make(map[string]sharding.Manifest),
+		verified:     make(map[string]bool),
+		tombstones:   make(map[string]tombstone),
+		connected:    make(map[peer.ID]bool),
+	}
+	if node.store == nil {
+		var err error
+		node.store, err = newBackend(config.Backend, node.shardsDir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: %v", err)
+		}
+	}
+	if migrator, ok := node.store.(store.Migrator); ok {
+		err := migrator.Migrate()
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate shards: %v", err)
+		}
+	}
+	if cleaner, ok := node.store.(store.Cleaner); ok {
+		err := cleaner.RemoveTemp()
+		if err != nil {
+			return nil, fmt.Errorf("failed to clean up shards: %v", err)
+		}
+	}
+	limits, err := store.NewLimitedStore(node.store, config.Capacity)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	compactor, _ := node.store.(store.Compactor)
+	node.store, node.limits = limits, limits
+
+	node.cache, err = newFileCache(destDir, config.CacheSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+
+	err = node.loadShardMap()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load shard map: %v", err)
+	}
+	err = node.loadTombstones()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tombstones: %v", err)
 	}
 
 	h, err := libp2p.New(
@@ -67,6 +193,8 @@ func New(destDir string) (*P2PNode, error) {
 			node.connected[conn.RemotePeer()] = true
 			node.peerLock.Unlock()
 			fmt.Printf("Connected to peer: %s\n", conn.RemotePeer().String())
+			// Peers that were offline catch up on deletions they missed
+			go node.syncTombstones(conn.RemotePeer())
 		},
 		DisconnectedF: func(n network.Network, conn network.Conn) {
 			node.peerLock.Lock()
@@ -83,9 +211,51 @@ func New(destDir string) (*P2PNode, error) {
 
 	node.host.SetStreamHandler("/file/1.0.0", (&node).handleIncomingRequest)
 
+	if config.ScrubInterval > 0 {
+		node.scrubber.stop = make(chan struct{})
+		go (&node).scrubLoop(config.ScrubInterval)
+	}
+	if compactor != nil && config.CompactInterval > 0 {
+		node.compactStop = make(chan struct{})
+		go node.compactLoop(compactor, config.CompactInterval)
+	}
+
 	return &node, nil
 }
 
+// newBackend opens the store named by Config.Backend over dir
+func newBackend(backend string, dir string) (store.ShardStore, error) {
+	switch backend {
+	case "", "fs":
+		return store.NewFSStore(dir), nil
+	case "pack":
+		packStore, err := store.NewPackStore(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open pack store: %v", err)
+		}
+		return packStore, nil
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", backend)
+	}
+}
+
+// compactLoop compacts the store every interval until the node is closed
+func (n *P2PNode) compactLoop(compactor store.Compactor, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.compactStop:
+			return
+		case <-ticker.C:
+			err := compactor.Compact()
+			if err != nil {
+				fmt.Printf("Failed to compact shards: %v\n", err)
+			}
+		}
+	}
+}
+
 func configureMDNS(n *P2PNode) error {
 	mdnsService := mdns.NewMdnsService(n.host, "libp2p-file-upload", n)
 	if mdnsService == nil {
@@ -203,7 +373,17 @@ func (n *P2PNode) WaitForConnection(id peer.ID, timeout time.Duration) bool {
 
 // Close shuts down the P2P node
 func (n *P2PNode) Close() error {
-	err := n.host.Close()
+	if n.scrubber.stop != nil {
+		close(n.scrubber.stop)
+	}
+	if n.compactStop != nil {
+		close(n.compactStop)
+	}
+	err := n.closeJournal()
+	if err != nil {
+		fmt.Printf("Failed to persist shard map: %v\n", err)
+	}
+	err = n.host.Close()
 	if err != nil {
 		return fmt.Errorf("failed to close host: %v", err)
 	}
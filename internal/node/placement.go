@@ -0,0 +1,37 @@
+package node
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"slices"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// rankPeers orders peers by rendezvous hashing: each peer scores the hash of
+// the key and its ID, and the highest scores come first. Any node that knows
+// the same peers computes the same order, and a peer joining or leaving only
+// moves the keys it wins or held.
+func rankPeers(key string, peers []peer.ID) []peer.ID {
+	scores := make(map[peer.ID][]byte, len(peers))
+	for _, pid := range peers {
+		score := sha256.Sum256(append([]byte(key+"\n"), pid...))
+		scores[pid] = score[:]
+	}
+	ranked := slices.Clone(peers)
+	slices.SortFunc(ranked, func(a, b peer.ID) int {
+		return bytes.Compare(scores[b], scores[a])
+	})
+	return ranked
+}
+
+// knownPeers returns the IDs of the peers we know about
+func (n *P2PNode) knownPeers() []peer.ID {
+	n.peerLock.Lock()
+	defer n.peerLock.Unlock()
+	peers := make([]peer.ID, 0, len(n.peerAddrs))
+	for peerID := range n.peerAddrs {
+		peers = append(peers, peerID)
+	}
+	return peers
+}
@@ -0,0 +1,43 @@
+package node
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+)
+
+// TestRankPeers checks every node ranks peers the same way whatever order it
+// learned them in, that a peer leaving only moves the shards it held, and
+// that shards are spread over all peers
+func TestRankPeers(t *testing.T) {
+	var peers []peer.ID
+	for range 5 {
+		peers = append(peers, test.RandPeerIDFatal(t))
+	}
+	reversed := slices.Clone(peers)
+	slices.Reverse(reversed)
+
+	first := make(map[peer.ID]int)
+	for i := range 1000 {
+		key := fmt.Sprintf("file.%d", i)
+		ranked := rankPeers(key, peers)
+		if !slices.Equal(ranked, rankPeers(key, reversed)) {
+			t.Fatalf("Ranking of %s depends on the order peers are known in", key)
+		}
+		first[ranked[0]]++
+
+		// The others keep their order when a peer leaves
+		left := slices.DeleteFunc(slices.Clone(ranked), func(pid peer.ID) bool { return pid == peers[0] })
+		if !slices.Equal(rankPeers(key, peers[1:]), left) {
+			t.Fatalf("Ranking of %s changed beyond the peer that left", key)
+		}
+	}
+	for _, pid := range peers {
+		if first[pid] < 100 {
+			t.Errorf("Peer %s ranks first for only %d of 1000 shards", pid, first[pid])
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"shard/internal/sharding"
+	"shard/internal/types"
+	"slices"
+	"sync"
+	"time"
+)
+
+// scrubBlockSize is the most read from a shard between rate limit checks
+const scrubBlockSize = 64 * 1024
+
+// scrubber tracks the background verification of stored shards
+type scrubber struct {
+	stop chan struct{}
+
+	mu    sync.Mutex
+	stats types.ScrubStats
+}
+
+// scrubLoop scrubs the store every interval until the node is closed
+func (n *P2PNode) scrubLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.scrubber.stop:
+			return
+		case <-ticker.C:
+			n.scrubOnce()
+		}
+	}
+}
+
+// ScrubStats returns the results of the scrubs so far
+func (n *P2PNode) ScrubStats() types.ScrubStats {
+	n.scrubber.mu.Lock()
+	defer n.scrubber.mu.Unlock()
+	return n.scrubber.stats
+}
+
+// scrubOnce re-hashes every stored shard once. Shards that no longer match
+// their digest are quarantined and fetched again from peers.
+func (n *P2PNode) scrubOnce() {
+	fmt.Println("Scrubbing stored shards")
+	n.updateScrubStats(func(stats *types.ScrubStats) {
+		stats.Running = true
+		stats.LastStarted = time.Now().UTC()
+	})
+	// A pass stopped by Close is no longer running either
+	defer n.updateScrubStats(func(stats *types.ScrubStats) { stats.Running = false })
+	limiter := &throttle{rate: n.config.ScrubRate, start: time.Now(), stop: n.scrubber.stop}
+
+	// Contents shared by several files are checked once
+	n.shardMapMutex.RLock()
+	owners := make(map[string][]sharding.Shard)
+	files := make(map[string][]string)
+	for file, shards := range n.shardMap {
+		for _, shard := range shards {
+			if shard.Digest == "" {
+				continue
+			}
+			owners[shard.Digest] = append(owners[shard.Digest], shard)
+			files[shard.Digest] = append(files[shard.Digest], file)
+		}
+	}
+	n.shardMapMutex.RUnlock()
+
+	for digest := range owners {
+		select {
+		case <-n.scrubber.stop:
+			return
+		default:
+		}
+
+		size, ok, err := n.verifyStoredShard(digest, limiter)
+		if err != nil {
+			fmt.Printf("Failed to scrub shard %s: %v\n", digest, err)
+			continue
+		}
+		n.updateScrubStats(func(stats *types.ScrubStats) {
+			stats.ShardsChecked++
+			stats.BytesChecked += size
+		})
+		if ok {
+			continue
+		}
+
+		fmt.Printf("Shard contents %s failed verification\n", digest)
+		n.updateScrubStats(func(stats *types.ScrubStats) { stats.Corrupt++ })
+		n.repairShard(digest, files[digest], owners[digest])
+	}
+
+	n.updateScrubStats(func(stats *types.ScrubStats) {
+		stats.Passes++
+		stats.LastFinished = time.Now().UTC()
+	})
+	fmt.Println("Finished scrubbing stored shards")
+}
+
+// verifyStoredShard hashes stored contents, no faster than the limiter
+// allows, and reports whether they still match their digest
+func (n *P2PNode) verifyStoredShard(digest string, limiter *throttle) (int64, bool, error) {
+	reader, err := n.shardStore().Get(digest)
+	if err != nil {
+		return 0, false, err
+	}
+	defer reader.Close()
+
+	hasher := sha256.New()
+	buffer := make([]byte, scrubBlockSize)
+	var size int64
+	for {
+		read, err := reader.Read(buffer)
+		hasher.Write(buffer[:read])
+		size += int64(read)
+		limiter.wait(read)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return size, false, err
+		}
+	}
+	return size, hex.EncodeToString(hasher.Sum(nil)) == digest, nil
+}
+
+// throttle keeps the reads of a whole scrub pass under a rate
+type throttle struct {
+	rate  int64 // bytes per second, zero is unlimited
+	start time.Time
+	read  int64
+	stop  chan struct{} // cuts a wait short when the node closes
+}
+
+// wait counts n more bytes read and sleeps off whatever the pass is ahead of
+// the rate
+func (t *throttle) wait(n int) {
+	t.read += int64(n)
+	if t.rate <= 0 {
+		return
+	}
+	due := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+	if ahead := due - time.Since(t.start); ahead > 0 {
+		select {
+		case <-t.stop:
+		case <-time.After(ahead):
+		}
+	}
+}
+
+// repairShard moves corrupt contents to quarantine and fetches the shards
+// using them again from peers, through the same path as any download
+func (n *P2PNode) repairShard(digest string, files []string, shards []sharding.Shard) {
+	err := n.quarantineShard(digest)
+	if err != nil {
+		fmt.Printf("Failed to quarantine shard %s: %v\n", digest, err)
+	}
+
+	for i, shard := range shards {
+		n.discardShards(files[i], []int{shard.Index})
+	}
+	for i, shard := range shards {
+		n.fetchShards(files[i], []int{shard.Index})
+
+		repaired := slices.Contains(n.shardIndexes(files[i]), shard.Index)
+		n.updateScrubStats(func(stats *types.ScrubStats) {
+			if repaired {
+				stats.Repaired++
+			} else {
+				stats.Unrepaired++
+			}
+		})
+		if !repaired {
+			fmt.Printf("No peer could replace shard %s\n", shard.Hash)
+		}
+	}
+}
+
+// quarantineDir is where corrupt shard contents are kept for inspection
+func (n *P2PNode) quarantineDir() string {
+	return filepath.Join(n.config.DataDir, "quarantine")
+}
+
+// quarantineShard copies corrupt contents out of the store so they are no
+// longer served but can still be looked at
+func (n *P2PNode) quarantineShard(digest string) error {
+	reader, err := n.shardStore().Get(digest)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	err = os.MkdirAll(n.quarantineDir(), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %v", err)
+	}
+	file, err := os.Create(filepath.Join(n.quarantineDir(), digest))
+	if err != nil {
+		return fmt.Errorf("failed to create quarantined shard: %v", err)
+	}
+	defer file.Close()
+	_, err = io.Copy(file, reader)
+	if err != nil {
+		return fmt.Errorf("failed to write quarantined shard: %v", err)
+	}
+	return nil
+}
+
+func (n *P2PNode) updateScrubStats(update func(*types.ScrubStats)) {
+	n.scrubber.mu.Lock()
+	update(&n.scrubber.stats)
+	n.scrubber.mu.Unlock()
+}
@@ -0,0 +1,97 @@
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"shard/internal/sharding"
+	"shard/internal/store"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestScrubQuarantinesCorruptShard corrupts a stored shard and checks the
+// scrubber finds it, moves it to quarantine and stops serving it. Without
+// peers the shard can't be repaired.
+func TestScrubQuarantinesCorruptShard(t *testing.T) {
+	dataDir, shardsDir := t.TempDir(), t.TempDir()
+	shardStore := store.NewFSStore(shardsDir)
+	node := restartNode(t, dataDir, t.TempDir(), shardStore)
+
+	content := make([]byte, 3*sharding.ShardSize)
+	rand.Read(content)
+	shards, err := sharding.Split(bytes.NewReader(content), "file", node.shardStore(), sharding.SplitOptions{})
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	node.shardMapMutex.Lock()
+	node.recordShardChange(journalEntry{Op: journalAdd, File: "file", Shards: shards})
+	node.shardMapMutex.Unlock()
+
+	corrupt := shards[1].Digest
+	path := shardStore.Path(corrupt)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read shard: %v", err)
+	}
+	data[0] ^= 0xff
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatalf("Failed to corrupt shard: %v", err)
+	}
+
+	node.scrubOnce()
+
+	stats := node.ScrubStats()
+	if stats.Passes != 1 || stats.ShardsChecked != 3 || stats.Corrupt != 1 || stats.Unrepaired != 1 || stats.Running {
+		t.Errorf("Unexpected scrub stats %+v", stats)
+	}
+	if node.shardStore().Has(corrupt) {
+		t.Error("Corrupt shard is still in the store")
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "quarantine", corrupt)); err != nil {
+		t.Errorf("Corrupt shard was not quarantined: %v", err)
+	}
+	if indexes := node.shardIndexes("file"); len(indexes) != 2 {
+		t.Errorf("Expected the corrupt shard to be dropped from the map, got %v", indexes)
+	}
+}
+
+// TestScrubRateSpansShards scrubs shards smaller than a read block and checks
+// the rate still holds over the whole pass, and that a pass cut short by
+// Close is not reported as running
+func TestScrubRateSpansShards(t *testing.T) {
+	shards := store.NewMemStore()
+	node := restartNode(t, t.TempDir(), t.TempDir(), shards)
+	node.config.ScrubRate = 8 * 1024
+
+	node.shardMapMutex.Lock()
+	for i := range 4 {
+		info, err := shards.Put("", strings.NewReader(strings.Repeat(strconv.Itoa(i), 1024)))
+		if err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		shard := sharding.Shard{Index: i, Hash: "file." + strconv.Itoa(i), Digest: info.Key}
+		node.recordShardChange(journalEntry{Op: journalAdd, File: "file", Shards: []sharding.Shard{shard}})
+	}
+	node.shardMapMutex.Unlock()
+
+	start := time.Now()
+	node.scrubOnce()
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Scrubbing 4KB at 8KB/s took only %v", elapsed)
+	}
+	if stats := node.ScrubStats(); stats.ShardsChecked != 4 || stats.Corrupt != 0 {
+		t.Errorf("Unexpected scrub stats %+v", stats)
+	}
+
+	node.scrubber.stop = make(chan struct{})
+	close(node.scrubber.stop)
+	node.scrubOnce()
+	if stats := node.ScrubStats(); stats.Running || stats.Passes != 1 {
+		t.Errorf("Expected a stopped pass to be neither running nor counted, got %+v", stats)
+	}
+}
@@ -0,0 +1,339 @@
+package node
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"shard/internal/sharding"
+	"slices"
+	"strings"
+)
+
+const (
+	journalFile  = "shardmap.journal"
+	snapshotFile = "shardmap.snapshot"
+
+	// snapshotInterval is how many journal entries are written before the
+	// whole shard map is snapshotted and the journal starts over
+	snapshotInterval = 1000
+)
+
+// Journal operations
+const (
+	journalAdd     = "add"
+	journalRemove  = "remove"
+	journalRoot    = "root"
+	journalDelete  = "delete"
+	journalReplace = "replace"
+)
+
+// journalEntry is one change to the shard map
+type journalEntry struct {
+	Op      string
+	File    string
+	Shards  []sharding.Shard `json:",omitempty"`
+	Indexes []int            `json:",omitempty"`
+	Root    string           `json:",omitempty"`
+}
+
+// shardSnapshot is the whole shard map at the time it was written
+type shardSnapshot struct {
+	Shards map[string][]sharding.Shard
+	Roots  map[string]string
+}
+
+// shardJournal persists the shard map in dataDir: every change is appended
+// to a journal, which a snapshot replaces every snapshotInterval entries
+type shardJournal struct {
+	dir     string
+	file    *os.File
+	entries int
+}
+
+// applyJournalEntry applies a change to a shard map and its Merkle roots
+func applyJournalEntry(shardMap map[string][]sharding.Shard, roots map[string]string, entry journalEntry) {
+	switch entry.Op {
+	case journalAdd:
+		for _, shard := range entry.Shards {
+			if !hasShardIndex(shardMap[entry.File], shard.Index) {
+				shardMap[entry.File] = append(shardMap[entry.File], shard)
+			}
+		}
+	case journalRemove:
+		kept := make([]sharding.Shard, 0, len(shardMap[entry.File]))
+		for _, shard := range shardMap[entry.File] {
+			if !slices.Contains(entry.Indexes, shard.Index) {
+				kept = append(kept, shard)
+			}
+		}
+		shardMap[entry.File] = kept
+	case journalRoot:
+		if _, exists := roots[entry.File]; !exists && entry.Root != "" {
+			roots[entry.File] = entry.Root
+		}
+	case journalDelete:
+		delete(shardMap, entry.File)
+		delete(roots, entry.File)
+	case journalReplace:
+		shardMap[entry.File] = entry.Shards
+		roots[entry.File] = entry.Root
+	}
+}
+
+// recordShardChange applies a change to the shard map and journals it. The
+// caller must hold shardMapMutex.
+func (n *P2PNode) recordShardChange(entry journalEntry) {
+	applyJournalEntry(n.shardMap, n.merkleRoots, entry)
+	if n.journal == nil {
+		return
+	}
+
+	err := n.journal.append(entry)
+	if err != nil {
+		fmt.Printf("Failed to journal shard map change: %v\n", err)
+		return
+	}
+	if n.journal.entries >= snapshotInterval {
+		err = n.journal.snapshot(n.shardMap, n.merkleRoots)
+		if err != nil {
+			fmt.Printf("Failed to snapshot shard map: %v\n", err)
+		}
+	}
+}
+
+// loadShardMap restores the shard map from the snapshot and journal in the
+// data directory. Without a journal the map is rebuilt by scanning the store.
+func (n *P2PNode) loadShardMap() error {
+	journal := &shardJournal{dir: n.config.DataDir}
+
+	snapshot, err := journal.readSnapshot()
+	if err != nil {
+		return err
+	}
+	for file, shards := range snapshot.Shards {
+		n.shardMap[file] = shards
+	}
+	for file, root := range snapshot.Roots {
+		n.merkleRoots[file] = root
+	}
+
+	replayed, torn, err := journal.replay(func(entry journalEntry) {
+		applyJournalEntry(n.shardMap, n.merkleRoots, entry)
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Println("No shard map journal found, scanning stored shards")
+		err = n.rescanShards()
+		replayed = len(n.shardMap)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Loaded shard map with %d files\n", len(n.shardMap))
+
+	// Start over from a snapshot, which also drops a torn entry so nothing
+	// is appended after it
+	if replayed > 0 || torn {
+		err = journal.snapshot(n.shardMap, n.merkleRoots)
+		if err != nil {
+			return err
+		}
+	}
+	n.journal = journal
+	return nil
+}
+
+// rescanShards rebuilds the shard map from the contents in the store, using
+// the stored manifests to tell which file each one belongs to. Shards stored
+// under their name rather than a digest are recognised by it.
+func (n *P2PNode) rescanShards() error {
+	keys, err := n.shardStore().List()
+	if err != nil {
+		return err
+	}
+	held := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		held[key] = true
+	}
+
+	manifestFiles, err := os.ReadDir(n.manifestsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to list manifests: %v", err)
+	}
+	for _, entry := range manifestFiles {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		manifest, ok := n.localManifest(entry.Name())
+		if !ok {
+			continue
+		}
+		applyJournalEntry(n.shardMap, n.merkleRoots, journalEntry{Op: journalRoot, File: manifest.Hash, Root: manifest.Root})
+		for _, shard := range manifest.Shards {
+			if held[sharding.ShardKey(shard)] {
+				applyJournalEntry(n.shardMap, n.merkleRoots, journalEntry{Op: journalAdd, File: manifest.Hash, Shards: []sharding.Shard{shard}})
+			}
+		}
+	}
+
+	for _, key := range keys {
+		file, index, ok := parseShardName(key)
+		if !ok {
+			continue
+		}
+		info, err := n.shardStore().Stat(key)
+		if err != nil {
+			continue
+		}
+		shard := sharding.Shard{Index: index, Hash: key, Size: info.Size}
+		applyJournalEntry(n.shardMap, n.merkleRoots, journalEntry{Op: journalAdd, File: file, Shards: []sharding.Shard{shard}})
+	}
+	return nil
+}
+
+// closeJournal snapshots the shard map if it changed and closes the journal
+func (n *P2PNode) closeJournal() error {
+	if n.journal == nil || n.journal.entries == 0 {
+		return nil
+	}
+	n.shardMapMutex.Lock()
+	defer n.shardMapMutex.Unlock()
+	return n.journal.snapshot(n.shardMap, n.merkleRoots)
+}
+
+// readSnapshot returns the last snapshot, empty when there is none
+func (j *shardJournal) readSnapshot() (shardSnapshot, error) {
+	var snapshot shardSnapshot
+	data, err := os.ReadFile(filepath.Join(j.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return snapshot, fmt.Errorf("failed to read shard map snapshot: %v", err)
+	}
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return snapshot, fmt.Errorf("failed to decode shard map snapshot: %v", err)
+	}
+	return snapshot, nil
+}
+
+// replay calls apply for every entry in the journal and returns how many
+// there were. A torn entry, left by a crash while writing it, ends the replay
+// and is reported.
+func (j *shardJournal) replay(apply func(journalEntry)) (int, bool, error) {
+	file, err := os.Open(filepath.Join(j.dir, journalFile))
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			fmt.Printf("Stopping shard map replay at a bad entry: %v\n", err)
+			return count, true, nil
+		}
+		apply(entry)
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, false, fmt.Errorf("failed to read shard map journal: %v", err)
+	}
+	return count, false, nil
+}
+
+// append writes an entry at the end of the journal
+func (j *shardJournal) append(entry journalEntry) error {
+	if j.file == nil {
+		err := os.MkdirAll(j.dir, 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create data directory: %v", err)
+		}
+		j.file, err = os.OpenFile(filepath.Join(j.dir, journalFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open shard map journal: %v", err)
+		}
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal entry: %v", err)
+	}
+	_, err = j.file.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to write journal entry: %v", err)
+	}
+	err = j.file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync shard map journal: %v", err)
+	}
+	j.entries++
+	return nil
+}
+
+// snapshot writes the whole shard map and empties the journal
+func (j *shardJournal) snapshot(shardMap map[string][]sharding.Shard, roots map[string]string) error {
+	data, err := json.Marshal(shardSnapshot{Shards: shardMap, Roots: roots})
+	if err != nil {
+		return fmt.Errorf("failed to encode shard map snapshot: %v", err)
+	}
+	err = os.MkdirAll(j.dir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create data directory: %v", err)
+	}
+
+	err = writeDurably(filepath.Join(j.dir, snapshotFile), data)
+	if err != nil {
+		return fmt.Errorf("failed to store shard map snapshot: %v", err)
+	}
+
+	// Everything journaled so far is in the snapshot
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	err = os.WriteFile(filepath.Join(j.dir, journalFile), nil, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reset shard map journal: %v", err)
+	}
+	j.entries = 0
+	return nil
+}
+
+// writeDurably replaces the file at path with data, so that a crash leaves
+// either the old or the new contents
+func writeDurably(path string, data []byte) error {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
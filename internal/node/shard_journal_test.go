@@ -0,0 +1,161 @@
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"shard/internal/sharding"
+	"shard/internal/store"
+	"strings"
+	"testing"
+)
+
+// restartNode builds a node over existing directories and store the way New
+// does, without starting a host
+func restartNode(t *testing.T, dataDir, manifestsDir string, shards store.ShardStore) *P2PNode {
+	node := &P2PNode{
+		config:       Config{DataDir: dataDir},
+		store:        shards,
+		manifestsDir: manifestsDir,
+		shardMap:     make(map[string][]sharding.Shard),
+		merkleRoots:  make(map[string]string),
+		manifests:    make(map[string]sharding.Manifest),
+		verified:     make(map[string]bool),
+		tombstones:   make(map[string]tombstone),
+	}
+	err := node.loadShardMap()
+	if err != nil {
+		t.Fatalf("loadShardMap failed: %v", err)
+	}
+	err = node.loadTombstones()
+	if err != nil {
+		t.Fatalf("loadTombstones failed: %v", err)
+	}
+	return node
+}
+
+// TestShardMapSurvivesRestart changes the shard map, drops the node without
+// closing it and checks a new node over the same data directory knows the
+// same shards
+func TestShardMapSurvivesRestart(t *testing.T) {
+	dataDir, manifestsDir := t.TempDir(), t.TempDir()
+	shards := store.NewMemStore()
+
+	node := restartNode(t, dataDir, manifestsDir, shards)
+	node.updateShardMetadata("file.0", 10, sharding.Shard{Digest: "d0"})
+	node.updateShardMetadata("file.1", 10, sharding.Shard{Digest: "d1"})
+	node.updateShardMetadata("file.2", 10, sharding.Shard{Digest: "d2"})
+	node.learnMerkleRoot("file", "root")
+	node.discardShards("file", []int{2})
+
+	// The journal is replayed
+	node = restartNode(t, dataDir, manifestsDir, shards)
+	if maxIndex := node.getMaxShardIndex("file"); maxIndex != 1 {
+		t.Errorf("Expected max index 1 after restart, got %d", maxIndex)
+	}
+	if node.merkleRoot("file") != "root" {
+		t.Errorf("Merkle root was lost on restart")
+	}
+
+	// And folded into the snapshot the restart wrote
+	node = restartNode(t, dataDir, manifestsDir, shards)
+	if got := node.shardIndexes("file"); len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Errorf("Expected shards 0 and 1 after second restart, got %v", got)
+	}
+}
+
+// TestShardMapTornFirstEntry starts over a journal whose only entry was torn
+// by a crash and checks entries written afterwards survive the next restart
+func TestShardMapTornFirstEntry(t *testing.T) {
+	dataDir, manifestsDir := t.TempDir(), t.TempDir()
+	err := os.WriteFile(filepath.Join(dataDir, journalFile), []byte(`{"Op":"add","Fi`), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write torn journal: %v", err)
+	}
+
+	node := restartNode(t, dataDir, manifestsDir, store.NewMemStore())
+	node.updateShardMetadata("file.0", 10, sharding.Shard{Digest: "d0"})
+
+	node = restartNode(t, dataDir, manifestsDir, store.NewMemStore())
+	if got := node.shardIndexes("file"); len(got) != 1 {
+		t.Errorf("Expected the entry written after the torn one to survive, got %v", got)
+	}
+}
+
+// TestShardMapRescan starts a node without a journal over a store holding the
+// shards of a file and checks the map is rebuilt from the file's manifest
+func TestShardMapRescan(t *testing.T) {
+	manifestsDir := t.TempDir()
+	shards := store.NewMemStore()
+
+	content := strings.Repeat("rescan ", sharding.ShardSize/3)
+	hash := sharding.ContentDigest([]byte(content))
+	split, err := sharding.Split(strings.NewReader(content), hash, shards, sharding.SplitOptions{})
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	manifest := sharding.NewManifest(hash, int64(len(content)), split)
+	uploader := restartNode(t, t.TempDir(), manifestsDir, shards)
+	err = uploader.storeManifest(manifest)
+	if err != nil {
+		t.Fatalf("storeManifest failed: %v", err)
+	}
+
+	node := restartNode(t, t.TempDir(), manifestsDir, shards)
+	if maxIndex := node.getMaxShardIndex(hash); maxIndex != len(split)-1 {
+		t.Errorf("Expected max index %d after rescan, got %d", len(split)-1, maxIndex)
+	}
+	if node.merkleRoot(hash) != manifest.Root {
+		t.Errorf("Merkle root was not recovered from the manifest")
+	}
+}
+
+// TestPackBackendSurvivesRestart keeps a node's shards in segment files and
+// checks they are found after a restart and gone once their file is deleted
+// and the segments compacted
+func TestPackBackendSurvivesRestart(t *testing.T) {
+	dataDir, manifestsDir, shardsDir := t.TempDir(), t.TempDir(), t.TempDir()
+	if _, err := newBackend("tape", shardsDir); err == nil {
+		t.Error("Expected an unknown backend to be refused")
+	}
+	shards, err := newBackend("pack", shardsDir)
+	if err != nil {
+		t.Fatalf("newBackend failed: %v", err)
+	}
+	node := restartNode(t, dataDir, manifestsDir, shards)
+
+	content := strings.Repeat("packed ", sharding.ShardSize/3)
+	split, err := sharding.Split(strings.NewReader(content), "file", node.shardStore(), sharding.SplitOptions{})
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	node.shardMapMutex.Lock()
+	node.recordShardChange(journalEntry{Op: journalAdd, File: "file", Shards: split})
+	node.shardMapMutex.Unlock()
+
+	shards, err = newBackend("pack", shardsDir)
+	if err != nil {
+		t.Fatalf("Reopening the pack store failed: %v", err)
+	}
+	node = restartNode(t, dataDir, manifestsDir, shards)
+	for _, shard := range split {
+		if !node.shardStore().Has(sharding.ShardKey(shard)) {
+			t.Fatalf("Shard %d is missing after restart", shard.Index)
+		}
+	}
+
+	node.removeFile("file")
+	packStore := shards.(*store.PackStore)
+	err = packStore.Compact()
+	if err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if keys, _ := packStore.List(); len(keys) != 0 {
+		t.Errorf("Expected no shards after deleting the file, got %v", keys)
+	}
+	segments, _ := filepath.Glob(filepath.Join(shardsDir, "segment-*"))
+	for _, path := range segments {
+		if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+			t.Errorf("Expected compaction to reclaim %s", path)
+		}
+	}
+}
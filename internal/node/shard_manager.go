@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"shard/internal/sharding"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -18,7 +19,7 @@ func hasShardIndex(shards []sharding.Shard, index int) bool {
 	return false
 }
 
-func (n *P2PNode) updateShardMetadata(filename string, byteSize int64) {
+func (n *P2PNode) updateShardMetadata(filename string, byteSize int64, header sharding.Shard) {
 	fmt.Println("Updating shards map")
 
 	// Extract original file hash and shard index from filename
@@ -38,23 +39,15 @@ func (n *P2PNode) updateShardMetadata(filename string, byteSize int64) {
 		return
 	}
 
-	// Create shard information
-	shard := sharding.Shard{
-		Index: shardIdx,
-		Hash:  filename,
-		Size:  byteSize,
-	}
+	// Create shard information, keeping the scheme sent by the uploader
+	shard := header
+	shard.Index = shardIdx
+	shard.Hash = filename
+	shard.Size = byteSize
 
 	// Add to shards map
 	n.shardMapMutex.Lock()
-	shards, exists := n.shardMap[originalFile]
-	if !exists {
-		n.shardMap[originalFile] = make([]sharding.Shard, 0)
-		shards = n.shardMap[originalFile]
-	}
-	if !hasShardIndex(shards, shardIdx) {
-		n.shardMap[originalFile] = append(shards, shard)
-	} 
+	n.recordShardChange(journalEntry{Op: journalAdd, File: originalFile, Shards: []sharding.Shard{shard}})
 	n.shardMapMutex.Unlock()
 
 	fmt.Println("After Update")
@@ -63,6 +56,62 @@ func (n *P2PNode) updateShardMetadata(filename string, byteSize int64) {
 	fmt.Printf("Updated shards map for file %s with shard %s\n", originalFile, shardIndex)
 }
 
+// parseShardName splits a "<filehash>.<index>" shard name
+func parseShardName(shardHash string) (string, int, bool) {
+	parts := strings.Split(filepath.Base(shardHash), ".")
+	if len(parts) != 2 {
+		return "", 0, false
+	}
+	index, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, false
+	}
+	return parts[0], index, true
+}
+
+// lookupShard returns the metadata we hold for a shard file, falling back to
+// the file's manifest and then to what can be derived from its name
+func (n *P2PNode) lookupShard(shardHash string) sharding.Shard {
+	shard := sharding.Shard{Hash: shardHash}
+	file, index, ok := parseShardName(shardHash)
+	if !ok {
+		return shard
+	}
+	shard.Index = index
+
+	n.shardMapMutex.RLock()
+	defer n.shardMapMutex.RUnlock()
+	for _, s := range n.shardMap[file] {
+		if s.Index == index {
+			return s
+		}
+	}
+	if s, ok := n.manifests[file].Shard(index); ok {
+		s.Hash = shardHash
+		return s
+	}
+	return shard
+}
+
+// merkleRoot returns the Merkle root we know for a file, if any
+func (n *P2PNode) merkleRoot(hash string) string {
+	n.shardMapMutex.RLock()
+	defer n.shardMapMutex.RUnlock()
+	return n.merkleRoots[hash]
+}
+
+// learnMerkleRoot records the root of a file unless we already know one
+func (n *P2PNode) learnMerkleRoot(hash string, root string) {
+	if root == "" {
+		return
+	}
+	n.shardMapMutex.Lock()
+	defer n.shardMapMutex.Unlock()
+	if _, exists := n.merkleRoots[hash]; !exists {
+		n.recordShardChange(journalEntry{Op: journalRoot, File: hash, Root: root})
+	}
+}
+
 // getMaxShardIndex returns the highest shard index for a given file hash
 func (n *P2PNode) getMaxShardIndex(hash string) int {
 	n.shardMapMutex.RLock()
@@ -84,3 +133,61 @@ func (n *P2PNode) getMaxShardIndex(hash string) int {
 
 	return maxIndex
 }
+
+// fileShards returns a copy of the shards we hold for a file
+func (n *P2PNode) fileShards(hash string) []sharding.Shard {
+	n.shardMapMutex.RLock()
+	defer n.shardMapMutex.RUnlock()
+	return slices.Clone(n.shardMap[hash])
+}
+
+// shardIndexes returns the indexes of the shards we hold for a file
+func (n *P2PNode) shardIndexes(hash string) []int {
+	n.shardMapMutex.RLock()
+	defer n.shardMapMutex.RUnlock()
+
+	indexes := make([]int, 0, len(n.shardMap[hash]))
+	for _, shard := range n.shardMap[hash] {
+		indexes = append(indexes, shard.Index)
+	}
+	slices.Sort(indexes)
+	return indexes
+}
+
+// discardShards forgets the given shards of a file and deletes their
+// contents, unless other shards still use them
+func (n *P2PNode) discardShards(hash string, indexes []int) {
+	n.shardMapMutex.Lock()
+	defer n.shardMapMutex.Unlock()
+
+	var discarded []sharding.Shard
+	for _, shard := range n.shardMap[hash] {
+		if slices.Contains(indexes, shard.Index) {
+			discarded = append(discarded, shard)
+		}
+	}
+	n.recordShardChange(journalEntry{Op: journalRemove, File: hash, Indexes: indexes})
+
+	referenced := n.referencedKeys()
+	for _, shard := range discarded {
+		if referenced[sharding.ShardKey(shard)] {
+			continue
+		}
+		err := n.shardStore().Delete(sharding.ShardKey(shard))
+		if err != nil {
+			fmt.Printf("Failed to remove shard %s: %v\n", shard.Hash, err)
+		}
+	}
+}
+
+// referencedKeys returns the store keys the shard map still uses. The caller
+// must hold shardMapMutex.
+func (n *P2PNode) referencedKeys() map[string]bool {
+	referenced := make(map[string]bool)
+	for _, shards := range n.shardMap {
+		for _, shard := range shards {
+			referenced[sharding.ShardKey(shard)] = true
+		}
+	}
+	return referenced
+}
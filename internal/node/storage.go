@@ -2,60 +2,177 @@ package node
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
 	"shard/internal/sharding"
+	"shard/internal/store"
+
+	"github.com/libp2p/go-libp2p/core/network"
 )
 
-func (n *P2PNode) downloadShardFile(shardPath string, reader *bufio.Reader) (sharding.Shard, error) {
-	_, written, err := n.createAndWriteFile(shardPath, reader)
+func (n *P2PNode) downloadShardFile(shardPath string, header sharding.Shard, reader *bufio.Reader) (sharding.Shard, error) {
+	// Prefer the digest we already know over the one the peer claims
+	if known := n.lookupShard(shardPath); known.Digest != "" {
+		header.Digest = known.Digest
+	}
+
+	contents, err := limitShardContents(header, reader)
+	if err != nil {
+		return sharding.Shard{}, err
+	}
+	digest, written, err := n.storeShardContents(header.Digest, contents)
 	if err != nil {
 		return sharding.Shard{}, fmt.Errorf("failed to write file: %v", err)
 	}
+	header.Digest = digest
 
 	// Create shard metadata
-	return n.createShardMetadata(shardPath, written)
+	return n.createShardMetadata(shardPath, written, header)
 }
 
-func (n *P2PNode) handleFileUpload(reader *bufio.Reader, filename string) {
+func (n *P2PNode) handleFileUpload(stream network.Stream, reader *bufio.Reader, filename string) {
 	fmt.Println("Received file:", filename)
 
-	// Create and write to file
-	file, byteSize, err := n.createAndWriteFile(filename, reader)
+	header, err := readShardHeader(reader)
 	if err != nil {
 		fmt.Printf("Error with file handling: %v\n", err)
+		stream.Write([]byte("ERROR " + err.Error() + "\n"))
+		return
+	}
+	contents, err := limitShardContents(header.Shard, reader)
+	if err != nil {
+		fmt.Printf("Refusing shard %s: %v\n", filename, err)
+		stream.Write([]byte("ERROR " + err.Error() + "\n"))
 		return
 	}
-	defer file.Close()
 
-	n.updateShardMetadata(filename, byteSize)
-}
+	// Shards of deleted files are not taken back
+	if file, _, ok := parseShardName(filename); ok && n.isDeleted(file) {
+		fmt.Printf("Refusing shard %s of a deleted file\n", filename)
+		stream.Write([]byte("ERROR file was deleted\n"))
+		return
+	}
+	err = n.checkPushedShard(filename, header.Shard)
+	if err != nil {
+		fmt.Printf("Refusing shard %s: %v\n", filename, err)
+		stream.Write([]byte("ERROR " + err.Error() + "\n"))
+		return
+	}
 
-func (n *P2PNode) createAndWriteFile(filename string, reader *bufio.Reader) (*os.File, int64, error) {
-	// Create the file
-	fmt.Println("Writing to:", filepath.Join(n.shardsDir, filename))
+	// Contents we already hold, maybe for another file, are not sent again
+	if size, ok := n.hasShardContents(header.Digest); ok {
+		fmt.Printf("Already holding contents of %s\n", filename)
+		n.acceptShard(filename, size, header)
+		stream.Write([]byte("HAVE\n"))
+		return
+	}
+	if !n.hasRoomFor(header.Size) {
+		fmt.Printf("No room left for %s\n", filename)
+		stream.Write([]byte(responseFull + "\n"))
+		return
+	}
+	_, err = stream.Write([]byte("SEND\n"))
+	if err != nil {
+		fmt.Printf("Error asking for shard contents: %v\n", err)
+		return
+	}
 
-	// Create the directory if it doesn't exist
-	if err := os.MkdirAll(n.shardsDir, 0755); err != nil {
-		return nil, 0, fmt.Errorf("error creating directory: %v", err)
+	digest, byteSize, err := n.storeShardContents(header.Digest, contents)
+	if errors.Is(err, store.ErrFull) {
+		fmt.Printf("No room left for %s\n", filename)
+		stream.Write([]byte(responseFull + "\n"))
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error with file handling: %v\n", err)
+		stream.Write([]byte("ERROR " + err.Error() + "\n"))
+		return
 	}
-	fmt.Println("Created:", n.shardsDir)
-		
-	file, err := os.Create(filepath.Join(n.shardsDir, filename))
+	header.Digest = digest
+	n.acceptShard(filename, byteSize, header)
+
+	// Let the sender know the shard was stored intact
+	_, err = stream.Write([]byte("OK\n"))
 	if err != nil {
-		return nil, 0, fmt.Errorf("error creating file: %v", err)
+		fmt.Printf("Error sending OK response: %v\n", err)
+	}
+}
+
+// maxShardContents bounds what a peer may send as one shard: the largest
+// shard size plus room for encryption overhead
+const maxShardContents = sharding.MaxShardSize + 4096
+
+// limitShardContents stops reading a peer's stream at the size the shard
+// header announced, so a peer can't make us store more than one shard's worth
+func limitShardContents(header sharding.Shard, reader io.Reader) (io.Reader, error) {
+	if header.Size > maxShardContents {
+		return nil, fmt.Errorf("shard of %d bytes is larger than %d", header.Size, maxShardContents)
+	}
+	limit := header.Size
+	if limit <= 0 {
+		limit = maxShardContents
+	}
+	return io.LimitReader(reader, limit), nil
+}
+
+// checkPushedShard checks the digest of a shard pushed to us proves against
+// the Merkle root we know for its file. The root in the pusher's header is
+// not trusted.
+func (n *P2PNode) checkPushedShard(filename string, header sharding.Shard) error {
+	file, index, ok := parseShardName(filename)
+	if !ok {
+		return nil
+	}
+	root := n.merkleRoot(file)
+	if root == "" {
+		fmt.Printf("Warning: no Merkle root known for %s, accepting it unverified\n", filename)
+		return nil
 	}
+	if header.Digest == "" || !sharding.VerifyProof(root, header.Digest, index, header.Proof) {
+		return fmt.Errorf("shard proof does not match Merkle root %s", root)
+	}
+	return nil
+}
+
+// acceptShard records a shard pushed to us once its contents are stored
+func (n *P2PNode) acceptShard(filename string, size int64, header shardHeader) {
+	n.updateShardMetadata(filename, size, header.Shard)
+}
+
+// shardStore returns the store holding shard contents. Nodes not built by
+// New keep them in shardsDir.
+func (n *P2PNode) shardStore() store.ShardStore {
+	if n.store == nil {
+		return store.NewFSStore(n.shardsDir)
+	}
+	return n.store
+}
 
-	fmt.Println("Created file:", file.Name())
+// hasShardContents reports whether contents with the given digest are stored
+// and returns their size
+func (n *P2PNode) hasShardContents(digest string) (int64, bool) {
+	if digest == "" {
+		return 0, false
+	}
+	info, err := n.shardStore().Stat(digest)
+	if err != nil {
+		return 0, false
+	}
+	return info.Size, true
+}
 
-	// Copy the contents to the file
-	byteSize, err := io.Copy(file, reader)
+// storeShardContents stores shard contents received from a peer under their
+// digest and returns it. When digest is set the contents must match it.
+func (n *P2PNode) storeShardContents(digest string, reader io.Reader) (string, int64, error) {
+	info, err := n.shardStore().Put(digest, reader)
+	if errors.Is(err, store.ErrDigestMismatch) {
+		return "", 0, fmt.Errorf("shard %s failed digest verification", digest)
+	}
 	if err != nil {
-		file.Close() // Close file on error
-		return nil, 0, fmt.Errorf("error writing file: %v", err)
+		return "", 0, err
 	}
+	fmt.Println("Stored shard contents as", info.Key)
 
-	return file, byteSize, nil
+	return info.Key, info.Size, nil
 }
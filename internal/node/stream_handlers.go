@@ -3,10 +3,9 @@ package node
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
 	"shard/internal/sharding"
 	"strconv"
 	"strings"
@@ -19,10 +18,10 @@ import (
 func (n *P2PNode) sendShardToPeer(shardHash string, peerID peer.ID) error {
 	fmt.Println("Sending shard to peers")
 
-	shardPath := filepath.Join(n.shardsDir, shardHash)
+	header := n.shardHeader(shardHash)
 
-	// Open the shardFile
-	shardFile, err := os.Open(shardPath)
+	// Open the shard contents
+	shardFile, err := n.shardStore().Get(sharding.ShardKey(header.Shard))
 	if err != nil {
 		return fmt.Errorf("failed to open file: %v", err)
 	}
@@ -35,12 +34,32 @@ func (n *P2PNode) sendShardToPeer(shardHash string, peerID peer.ID) error {
 	}
 	defer stream.Close()
 
-	// First send the shard name
-	shardName := []byte(shardHash+ "\n")
-	_, err = stream.Write([]byte(requestTypeUpload + " " + string(shardName) + "\n"))
+	// First send the shard name and its metadata
+	_, err = stream.Write([]byte(requestTypeUpload + " " + shardHash + "\n"))
 	if err != nil {
 		return fmt.Errorf("failed to send shard name: %v", err)
 	}
+	err = writeShardHeader(stream, header)
+	if err != nil {
+		return err
+	}
+
+	// The peer skips contents it already holds under the same digest
+	reader := bufio.NewReader(stream)
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+	switch response = strings.TrimSpace(response); response {
+	case "HAVE":
+		fmt.Printf("Peer %s already holds shard %s\n", peerID, shardHash)
+		return nil
+	case "SEND":
+	case responseFull:
+		return errPeerFull
+	default:
+		return fmt.Errorf("peer rejected shard: %s", response)
+	}
 
 	// Then send the shard contents
 	_, err = io.Copy(stream, shardFile)
@@ -48,6 +67,23 @@ func (n *P2PNode) sendShardToPeer(shardHash string, peerID peer.ID) error {
 		return fmt.Errorf("failed to send shard file: %v", err)
 	}
 
+	// Signal the end of the shard and wait for the peer to verify it
+	err = stream.CloseWrite()
+	if err != nil {
+		return fmt.Errorf("failed to close stream for writing: %v", err)
+	}
+	response, err = reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+	switch response = strings.TrimSpace(response); response {
+	case "OK":
+	case responseFull:
+		return errPeerFull
+	default:
+		return fmt.Errorf("peer rejected shard: %s", response)
+	}
+
 	return nil
 }
 
@@ -78,41 +114,64 @@ func (n *P2PNode) requestShardFromPeer(peerID peer.ID, shardPath string) (shardi
 		return sharding.Shard{}, fmt.Errorf("peer does not have shard")
 	}
 
+	header, err := readShardHeader(reader)
+	if err != nil {
+		return sharding.Shard{}, err
+	}
+
+	// The peer is untrusted: its digest must prove against the file's root.
+	// Without a root downloadShardFile checks the contents against the digest
+	// we know, and when we don't know one either only the file hash can catch
+	// a bad shard.
+	if file, index, ok := parseShardName(shardPath); ok {
+		root := n.merkleRoot(file)
+		switch {
+		case root != "":
+			if !sharding.VerifyProof(root, header.Digest, index, header.Proof) {
+				return sharding.Shard{}, fmt.Errorf("shard proof does not match Merkle root %s", root)
+			}
+		case n.lookupShard(shardPath).Digest == "":
+			fmt.Printf("Warning: no Merkle root or digest known for %s, accepting it unverified\n", shardPath)
+		}
+	}
+
 	// Download the file and create shard metadata
-	return n.downloadShardFile(shardPath, reader)
+	return n.downloadShardFile(shardPath, header.Shard, reader)
 }
 
-func (n *P2PNode) requestMaxIndexOfShard(peerID peer.ID, shardPath string) (int, error) {
+// requestMaxIndexOfShard asks a peer for the highest shard index it holds of a
+// file and the file's Merkle root, which is empty when the peer doesn't know it
+func (n *P2PNode) requestMaxIndexOfShard(peerID peer.ID, shardPath string) (int, string, error) {
 	// Timeout to stream creation
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	// Create stream to peer
 	stream, err := n.host.NewStream(ctx, peerID, "/file/1.0.0")
 	if err != nil {
-		return -1, fmt.Errorf("failed to create stream: %v", err)
+		return -1, "", fmt.Errorf("failed to create stream: %v", err)
 	}
 	defer stream.Close()
 
 	fmt.Println("requesting max index of shard", shardPath)
 
 	if err := n.sendMaxIndexRequest(stream, shardPath); err != nil {
-		return -1, err
+		return -1, "", err
 	}
 
 	reader := bufio.NewReader(stream)
 	response, err := reader.ReadString('\n')
 	if err != nil {
-		return -1, fmt.Errorf("failed to read response: %v", err)
+		return -1, "", fmt.Errorf("failed to read response: %v", err)
 	}
 	fmt.Println("response", response)
 	if strings.TrimSpace(response) != "OK" {
-		return -1, fmt.Errorf("peer does not have shard, could not receive max index")
+		return -1, "", fmt.Errorf("peer does not have shard, could not receive max index")
 	}
 
 	// Read the max index
 	maxIndexStr, err := reader.ReadString('\n')
 	if err != nil {
-		return -1, fmt.Errorf("failed to read max index: %v", err)
+		return -1, "", fmt.Errorf("failed to read max index: %v", err)
 	}
 
 	fmt.Println("max index string", maxIndexStr)
@@ -120,15 +179,25 @@ func (n *P2PNode) requestMaxIndexOfShard(peerID peer.ID, shardPath string) (int,
 	maxIndexStr = strings.TrimSpace(maxIndexStr)
 	maxIndex, err := strconv.Atoi(maxIndexStr)
 	if err != nil {
-		return -1, fmt.Errorf("failed to convert max index to int: %v", err)
+		return -1, "", fmt.Errorf("failed to convert max index to int: %v", err)
 	}
-	return maxIndex, nil
+
+	// Read the Merkle root
+	root, err := reader.ReadString('\n')
+	if err != nil {
+		return -1, "", fmt.Errorf("failed to read merkle root: %v", err)
+	}
+	return maxIndex, strings.TrimSpace(root), nil
 }
 
 const (
-	requestTypeUpload   = "SHARD"
-	requestTypeGet      = "GET"
-	requestTypeMaxIndex = "MAX_INDEX"
+	requestTypeUpload      = "SHARD"
+	requestTypeGet         = "GET"
+	requestTypeMaxIndex    = "MAX_INDEX"
+	requestTypeManifest    = "MANIFEST"
+	requestTypeGetManifest = "GET_MANIFEST"
+	requestTypeUsage       = "USAGE"
+	requestTypeTombstones  = "TOMBSTONES"
 )
 
 func (n *P2PNode) handleIncomingRequest(stream network.Stream) {
@@ -144,22 +213,37 @@ func (n *P2PNode) handleIncomingRequest(stream network.Stream) {
 	fmt.Println("FirstLine", firstLine)
 	firstLine = strings.TrimSpace(firstLine)
 
+	// Only USAGE requests come without a payload
 	parts := strings.SplitN(firstLine, " ", 2)
-	if len(parts) < 2 {
+	if len(parts) < 2 && parts[0] != requestTypeUsage {
 		fmt.Println("Invalid request format")
 		return
 	}
 
 	requestType := parts[0]
-	payload := parts[1]
+	payload := ""
+	if len(parts) == 2 {
+		payload = parts[1]
+	}
 
 	switch requestType {
+	case requestTypeUpload:
+		n.handleFileUpload(stream, reader, payload)
 	case requestTypeGet:
 		n.handleGetRequest(stream, payload)
 	case requestTypeMaxIndex:
 		n.handleMaxIndexRequest(stream, payload)
+	case requestTypeManifest:
+		n.handleManifestUpload(stream, reader, payload)
+	case requestTypeGetManifest:
+		n.handleManifestRequest(stream, payload)
+	case requestTypeUsage:
+		n.handleUsageRequest(stream)
+	case requestTypeTombstones:
+		n.handleTombstones(stream, reader)
 	default:
-		n.handleFileUpload(reader, firstLine)
+		fmt.Println("Unknown request type:", requestType)
+		return
 	}
 
 	fmt.Printf("Handled %s request from peer: %s\n", requestType, stream.Conn().RemotePeer())
@@ -176,8 +260,14 @@ func (n *P2PNode) sendGetRequest(stream network.Stream, shardPath string) error
 }
 
 func (n *P2PNode) handleGetRequest(stream network.Stream, filename string) {
-	filepath := filepath.Join(n.shardsDir, filename)
-	file, err := os.Open(filepath)
+	header := n.shardHeader(filename)
+	if _, _, ok := parseShardName(filename); !ok {
+		// Shard contents can also be asked for by their CID
+		if digest, err := sharding.ParseFileID(filename); err == nil {
+			header = shardHeader{Shard: sharding.Shard{Hash: filename, Digest: digest}}
+		}
+	}
+	file, err := n.shardStore().Get(sharding.ShardKey(header.Shard))
 	if err != nil {
 		fmt.Println("File not found in this peer")
 		stream.Write([]byte("NOT FOUND\n"))
@@ -192,6 +282,14 @@ func (n *P2PNode) handleGetRequest(stream network.Stream, filename string) {
 		return
 	}
 
+	// Send shard metadata so the receiver knows the file's scheme and can
+	// check the shard against the file's Merkle root
+	err = writeShardHeader(stream, header)
+	if err != nil {
+		fmt.Printf("Error sending shard header: %v\n", err)
+		return
+	}
+
 	// Send file contents
 	_, err = io.Copy(stream, file)
 	if err != nil {
@@ -199,6 +297,53 @@ func (n *P2PNode) handleGetRequest(stream network.Stream, filename string) {
 	}
 }
 
+// shardHeader is the metadata line sent ahead of shard contents
+type shardHeader struct {
+	sharding.Shard
+	Root string `json:",omitempty"` // Merkle root of the shard's file
+}
+
+// shardHeader builds the header for a shard we hold
+func (n *P2PNode) shardHeader(shardHash string) shardHeader {
+	header := shardHeader{Shard: n.lookupShard(shardHash)}
+	if file, index, ok := parseShardName(shardHash); ok {
+		header.Root = n.merkleRoot(file)
+		// Proofs dropped from the manifest are rebuilt from its digests
+		manifest, held := n.localManifest(file)
+		if len(header.Proof) == 0 && held && manifest.Root == header.Root {
+			header.Proof = sharding.BuildMerkleTree(manifest.Shards).Proof(index)
+		}
+	}
+	return header
+}
+
+// writeShardHeader sends the shard metadata as a single JSON line
+func writeShardHeader(w io.Writer, shard shardHeader) error {
+	header, err := json.Marshal(shard)
+	if err != nil {
+		return fmt.Errorf("failed to encode shard header: %v", err)
+	}
+	_, err = w.Write(append(header, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to send shard header: %v", err)
+	}
+	return nil
+}
+
+// readShardHeader reads the shard metadata line sent by writeShardHeader
+func readShardHeader(reader *bufio.Reader) (shardHeader, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return shardHeader{}, fmt.Errorf("failed to read shard header: %v", err)
+	}
+	var header shardHeader
+	err = json.Unmarshal([]byte(line), &header)
+	if err != nil {
+		return shardHeader{}, fmt.Errorf("failed to decode shard header: %v", err)
+	}
+	return header, nil
+}
+
 // sendMaxIndexRequest sends a request to a peer to get the maximum index of a shard
 func (n *P2PNode) sendMaxIndexRequest(stream network.Stream, shardHash string) error {
 	fmt.Print("Sending MaxIndex request for shard:", requestTypeMaxIndex+" "+shardHash+"\n")
@@ -223,8 +368,120 @@ func (n *P2PNode) handleMaxIndexRequest(stream network.Stream, shardHash string)
 		fmt.Printf("Error sending OK response: %v\n", err)
 		return
 	}
-	_, err = stream.Write([]byte(fmt.Sprintf("%d\n", maxIndex)))
+	_, err = stream.Write([]byte(fmt.Sprintf("%d\n%s\n", maxIndex, n.merkleRoot(shardHash))))
 	if err != nil {
 		fmt.Printf("Error sending max index response: %v\n", err)
 	}
 }
+
+// sendManifestToPeer pushes a file manifest to a peer as a single JSON line
+func (n *P2PNode) sendManifestToPeer(manifest sharding.Manifest, peerID peer.ID) error {
+	data, err := manifest.Encode()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := n.host.NewStream(ctx, peerID, "/file/1.0.0")
+	if err != nil {
+		return fmt.Errorf("failed to create stream to peer %s: %v", peerID, err)
+	}
+	defer stream.Close()
+
+	_, err = stream.Write([]byte(requestTypeManifest + " " + manifest.Hash + "\n"))
+	if err != nil {
+		return fmt.Errorf("failed to send manifest request: %v", err)
+	}
+	_, err = stream.Write(append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to send manifest: %v", err)
+	}
+
+	response, err := bufio.NewReader(stream).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+	if response = strings.TrimSpace(response); response != "OK" {
+		return fmt.Errorf("peer rejected manifest: %s", response)
+	}
+	return nil
+}
+
+// handleManifestUpload stores a manifest pushed by a peer
+func (n *P2PNode) handleManifestUpload(stream network.Stream, reader *bufio.Reader, hash string) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		fmt.Printf("Error reading manifest: %v\n", err)
+		return
+	}
+
+	manifest, err := sharding.DecodeManifest(line)
+	if err == nil && manifest.Hash != hash {
+		err = fmt.Errorf("manifest describes %s, not %s", manifest.Hash, hash)
+	}
+	if err == nil {
+		err = n.acceptManifest(manifest)
+	}
+	if err != nil {
+		fmt.Printf("Rejecting manifest of %s: %v\n", hash, err)
+		stream.Write([]byte("ERROR " + err.Error() + "\n"))
+		return
+	}
+
+	_, err = stream.Write([]byte("OK\n"))
+	if err != nil {
+		fmt.Printf("Error sending OK response: %v\n", err)
+	}
+}
+
+// requestManifestFromPeer asks a peer for the manifest of a file
+func (n *P2PNode) requestManifestFromPeer(peerID peer.ID, hash string) (sharding.Manifest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := n.host.NewStream(ctx, peerID, "/file/1.0.0")
+	if err != nil {
+		return sharding.Manifest{}, fmt.Errorf("failed to create stream: %v", err)
+	}
+	defer stream.Close()
+
+	_, err = stream.Write([]byte(requestTypeGetManifest + " " + hash + "\n"))
+	if err != nil {
+		return sharding.Manifest{}, fmt.Errorf("failed to send manifest request: %v", err)
+	}
+
+	reader := bufio.NewReader(stream)
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		return sharding.Manifest{}, fmt.Errorf("failed to read response: %v", err)
+	}
+	if strings.TrimSpace(response) != "OK" {
+		return sharding.Manifest{}, fmt.Errorf("peer does not have manifest")
+	}
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return sharding.Manifest{}, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	return sharding.DecodeManifest(line)
+}
+
+// handleManifestRequest sends the manifest of a file if we hold it
+func (n *P2PNode) handleManifestRequest(stream network.Stream, hash string) {
+	manifest, ok := n.localManifest(hash)
+	if !ok {
+		stream.Write([]byte("NOT FOUND\n"))
+		return
+	}
+	data, err := manifest.Encode()
+	if err != nil {
+		fmt.Printf("Error encoding manifest: %v\n", err)
+		stream.Write([]byte("NOT FOUND\n"))
+		return
+	}
+
+	_, err = stream.Write(append([]byte("OK\n"), append(data, '\n')...))
+	if err != nil {
+		fmt.Printf("Error sending manifest: %v\n", err)
+	}
+}
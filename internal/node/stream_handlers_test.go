@@ -1,9 +1,13 @@
 package node
 
 import (
+	"bufio"
+	"bytes"
 	"io"
 	"os"
 	"path/filepath"
+	"shard/internal/sharding"
+	"shard/internal/store"
 	"strings"
 	"testing"
 
@@ -75,6 +79,194 @@ func TestHandleGetRequest(t *testing.T) {
 	}
 }
 
+// TestShardUploadInMemory pushes a shard into a node backed by a memory store
+// and reads it back by name and by CID, without touching disk
+func TestShardUploadInMemory(t *testing.T) {
+	node := P2PNode{
+		store:       store.NewMemStore(),
+		shardMap:    make(map[string][]sharding.Shard),
+		merkleRoots: make(map[string]string),
+	}
+
+	content := "in memory shard"
+	shard := sharding.Shard{Index: 0, Hash: "file.0", Digest: sharding.ContentDigest([]byte(content))}
+	var upload bytes.Buffer
+	err := writeShardHeader(&upload, shardHeader{Shard: shard})
+	if err != nil {
+		t.Fatalf("writeShardHeader failed: %v", err)
+	}
+	upload.WriteString(content)
+
+	stream := &mockStream{}
+	node.handleFileUpload(stream, bufio.NewReader(bytes.NewReader(upload.Bytes())), "file.0")
+	if string(stream.writeBuffer) != "SEND\nOK\n" {
+		t.Fatalf("Expected the shard to be stored, got '%s'", string(stream.writeBuffer))
+	}
+
+	// The same contents are not sent twice
+	stream = &mockStream{}
+	node.handleFileUpload(stream, bufio.NewReader(bytes.NewReader(upload.Bytes())), "file.0")
+	if string(stream.writeBuffer) != "HAVE\n" {
+		t.Errorf("Expected held contents to be skipped, got '%s'", string(stream.writeBuffer))
+	}
+
+	for _, name := range []string{"file.0", shard.CID()} {
+		stream = &mockStream{}
+		node.handleGetRequest(stream, name)
+		if !strings.HasPrefix(string(stream.writeBuffer), "OK\n") || !strings.HasSuffix(string(stream.writeBuffer), content) {
+			t.Errorf("Expected %s to be served, got '%s'", name, string(stream.writeBuffer))
+		}
+	}
+}
+
+// TestShardUploadWhenFull checks a full node answers FULL, whether the
+// header says the shard is too large or the contents turn out to be
+func TestShardUploadWhenFull(t *testing.T) {
+	limits, err := store.NewLimitedStore(store.NewMemStore(), 8)
+	if err != nil {
+		t.Fatalf("NewLimitedStore failed: %v", err)
+	}
+	node := P2PNode{
+		store:       limits,
+		limits:      limits,
+		shardMap:    make(map[string][]sharding.Shard),
+		merkleRoots: make(map[string]string),
+	}
+
+	content := "more than eight bytes"
+	for _, size := range []int64{int64(len(content)), 0} {
+		shard := sharding.Shard{Index: 0, Hash: "file.0", Size: size}
+		var upload bytes.Buffer
+		err = writeShardHeader(&upload, shardHeader{Shard: shard})
+		if err != nil {
+			t.Fatalf("writeShardHeader failed: %v", err)
+		}
+		upload.WriteString(content)
+
+		stream := &mockStream{}
+		node.handleFileUpload(stream, bufio.NewReader(&upload), "file.0")
+		if !strings.HasSuffix(string(stream.writeBuffer), responseFull+"\n") {
+			t.Errorf("Expected FULL for a %d byte header, got '%s'", size, string(stream.writeBuffer))
+		}
+	}
+	if used, _ := limits.Usage(); used != 0 {
+		t.Errorf("Refused shards use %d bytes", used)
+	}
+}
+
+// TestShardUploadProof pushes shards naming a Merkle root in their header and
+// checks the root is not learnt from them, and that once the manifest gives
+// the root only shards proving against it are taken
+func TestShardUploadProof(t *testing.T) {
+	node := restartNode(t, t.TempDir(), t.TempDir(), store.NewMemStore())
+	content := strings.Repeat("pushed shard ", 400)
+	hash := sharding.ContentDigest([]byte(content))
+	split, err := sharding.Split(strings.NewReader(content), hash, store.NewMemStore(), sharding.SplitOptions{ShardSize: 1024})
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	contents := func(shard sharding.Shard) string {
+		return content[shard.Index*1024 : min((shard.Index+1)*1024, len(content))]
+	}
+	push := func(header shardHeader) string {
+		var upload bytes.Buffer
+		err := writeShardHeader(&upload, header)
+		if err != nil {
+			t.Fatalf("writeShardHeader failed: %v", err)
+		}
+		upload.WriteString(contents(header.Shard))
+		stream := &mockStream{}
+		node.handleFileUpload(stream, bufio.NewReader(&upload), header.Hash)
+		return string(stream.writeBuffer)
+	}
+
+	forged := split[0]
+	forged.Proof = nil
+	push(shardHeader{Shard: forged, Root: "forged"})
+	if root := node.merkleRoot(hash); root != "" {
+		t.Fatalf("Learnt root %q from a pushed shard", root)
+	}
+
+	err = node.acceptManifest(sharding.NewManifest(hash, int64(len(content)), split))
+	if err != nil {
+		t.Fatalf("acceptManifest failed: %v", err)
+	}
+	unproven := split[1]
+	unproven.Proof = split[2].Proof
+	if response := push(shardHeader{Shard: unproven}); !strings.HasPrefix(response, "ERROR") {
+		t.Errorf("Expected a shard without a valid proof to be refused, got '%s'", response)
+	}
+	if response := push(shardHeader{Shard: split[2]}); response != "SEND\nOK\n" {
+		t.Errorf("Expected a proven shard to be stored, got '%s'", response)
+	}
+}
+
+// TestManifestExchange pushes a manifest into a node and reads it back with a
+// GET_MANIFEST request, from disk
+func TestManifestExchange(t *testing.T) {
+	node := P2PNode{
+		manifestsDir: t.TempDir(),
+		manifests:    make(map[string]sharding.Manifest),
+		merkleRoots:  make(map[string]string),
+	}
+
+	hash := sharding.ContentDigest([]byte("manifest test"))
+	shards, err := sharding.Split(strings.NewReader("manifest test"), hash, store.NewMemStore(), sharding.SplitOptions{})
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	manifest := sharding.NewManifest(hash, 13, shards)
+	data, err := manifest.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	upload := &mockStream{}
+	node.handleManifestUpload(upload, bufio.NewReader(strings.NewReader(string(data)+"\n")), hash)
+	if string(upload.writeBuffer) != "OK\n" {
+		t.Fatalf("Expected the manifest to be accepted, got '%s'", string(upload.writeBuffer))
+	}
+	if node.merkleRoot(hash) != manifest.Root {
+		t.Error("Merkle root was not learnt from the manifest")
+	}
+
+	// Forget the cached copy so the request is served from disk
+	node.manifests = make(map[string]sharding.Manifest)
+	request := &mockStream{}
+	node.handleManifestRequest(request, hash)
+	response := strings.TrimPrefix(string(request.writeBuffer), "OK\n")
+	received, err := sharding.DecodeManifest([]byte(response))
+	if err != nil {
+		t.Fatalf("Failed to decode served manifest: %v", err)
+	}
+	if received.Root != manifest.Root || received.Size != 13 {
+		t.Errorf("Served manifest differs: %+v", received)
+	}
+
+	// A manifest pushed under the wrong name is rejected
+	upload = &mockStream{}
+	node.handleManifestUpload(upload, bufio.NewReader(strings.NewReader(string(data)+"\n")), "other")
+	if !strings.HasPrefix(string(upload.writeBuffer), "ERROR") {
+		t.Errorf("Expected a mismatching manifest to be rejected, got '%s'", string(upload.writeBuffer))
+	}
+
+	// A manifest naming a path outside manifestsDir is rejected
+	escaping := manifest
+	escaping.Hash = "../escaped"
+	data, err = escaping.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	upload = &mockStream{}
+	node.handleManifestUpload(upload, bufio.NewReader(strings.NewReader(string(data)+"\n")), escaping.Hash)
+	if !strings.HasPrefix(string(upload.writeBuffer), "ERROR") {
+		t.Errorf("Expected a manifest with a bad hash to be rejected, got '%s'", string(upload.writeBuffer))
+	}
+	if _, err := os.Stat(filepath.Join(node.manifestsDir, "..", "escaped")); !os.IsNotExist(err) {
+		t.Errorf("Manifest was written outside the manifests directory")
+	}
+}
+
 // Mock implementation of network.Stream for testing
 type mockStream struct {
 	writeBuffer []byte
@@ -99,3 +291,30 @@ func (m *mockStream) Read(p []byte) (n int, err error) {
 func (m *mockStream) Close() error {
 	return nil
 }
+
+// TestRequestShardWithoutRoot fetches a shard of a file without a Merkle root
+// and checks its contents must still match the digest known from the manifest
+func TestRequestShardWithoutRoot(t *testing.T) {
+	shards := [][]byte{[]byte("first shard"), []byte("second shard")}
+	hash := sharding.ContentDigest(bytes.Join(shards, nil))
+	remote := newFakePeer(t, shards)
+	remote.corrupt, remote.corruptions = 1, 1
+
+	node := retrievalNode(t, remote)
+	node.manifests[hash] = sharding.Manifest{Hash: hash, ShardCount: 2, Shards: []sharding.Shard{
+		{Index: 0, Digest: sharding.ContentDigest(shards[0])},
+		{Index: 1, Digest: sharding.ContentDigest(shards[1])},
+	}}
+
+	_, err := node.requestShardFromPeer(remote.host.ID(), hash+".1")
+	if err == nil {
+		t.Fatalf("Expected corrupt contents to be rejected")
+	}
+	shard, err := node.requestShardFromPeer(remote.host.ID(), hash+".1")
+	if err != nil {
+		t.Fatalf("requestShardFromPeer failed: %v", err)
+	}
+	if shard.Digest != sharding.ContentDigest(shards[1]) {
+		t.Errorf("Expected digest %s, got %s", sharding.ContentDigest(shards[1]), shard.Digest)
+	}
+}
@@ -18,6 +18,7 @@ func (n *P2PNode) printShardsMap() {
 		for _, shardInfo := range shards {
 			fmt.Println("\tshardInfo.Index:", shardInfo.Index)
 			fmt.Println("\tshardInfo.Hash:", shardInfo.Hash)
+			fmt.Println("\tshardInfo.CID:", shardInfo.CID())
 			fmt.Println("\t---------------------------")
 		}
 	}
@@ -0,0 +1,155 @@
+package sharding
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// ChunkerConfig selects content defined chunking. Shard boundaries are picked
+// with a FastCDC style rolling gear hash, so an insert or delete only moves
+// the boundaries around the edit. A zero value keeps fixed ShardSize shards.
+type ChunkerConfig struct {
+	MinSize int64
+	AvgSize int64
+	MaxSize int64
+}
+
+// DefaultChunker returns content defined chunking averaging ShardSize shards
+func DefaultChunker() ChunkerConfig {
+	return ContentDefinedChunker(ShardSize)
+}
+
+// ContentDefinedChunker returns content defined chunking averaging avgSize.
+// Chunks stay within MaxShardSize, since each one is buffered whole.
+func ContentDefinedChunker(avgSize int64) ChunkerConfig {
+	return ChunkerConfig{
+		MinSize: avgSize / 4,
+		AvgSize: avgSize,
+		MaxSize: min(avgSize*4, MaxShardSize),
+	}
+}
+
+// ContentDefined reports whether the config asks for content defined chunking
+func (c ChunkerConfig) ContentDefined() bool {
+	return c != ChunkerConfig{}
+}
+
+// Validate checks the chunk sizes are usable
+func (c ChunkerConfig) Validate() error {
+	if !c.ContentDefined() {
+		return nil
+	}
+	if c.MinSize < 64 || c.MinSize > c.AvgSize || c.AvgSize > c.MaxSize {
+		return fmt.Errorf("invalid chunk sizes min=%d avg=%d max=%d", c.MinSize, c.AvgSize, c.MaxSize)
+	}
+	if c.MaxSize > MaxShardSize {
+		return fmt.Errorf("chunk size must not exceed %d bytes, got max=%d", MaxShardSize, c.MaxSize)
+	}
+	return nil
+}
+
+// gearTable maps every byte to a pseudo random 64 bit value. It is generated
+// from a fixed seed so every node cuts the same data at the same boundaries.
+var gearTable [256]uint64
+
+func init() {
+	seed := uint64(0x5368617264434443) // "ShardCDC"
+	for i := range gearTable {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// masks returns the strict mask used before the average size and the loose
+// one used after it (FastCDC normalized chunking)
+func (c ChunkerConfig) masks() (uint64, uint64) {
+	avgBits := bits.Len64(uint64(c.AvgSize)) - 1
+	strict := ^uint64(0) << (64 - min(avgBits+2, 63))
+	loose := ^uint64(0) << (64 - max(avgBits-2, 1))
+	return strict, loose
+}
+
+// cut returns the length of the next chunk at the start of data
+func (c ChunkerConfig) cut(data []byte) int {
+	n := len(data)
+	if int64(n) <= c.MinSize {
+		return n
+	}
+	if int64(n) > c.MaxSize {
+		n = int(c.MaxSize)
+	}
+	normal := min(int(c.AvgSize), n)
+	strict, loose := c.masks()
+
+	var fp uint64
+	i := int(c.MinSize)
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&strict == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&loose == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// maxShardSize returns the largest data shard the chunker can produce
+func maxShardSize(c ChunkerConfig, shardSize int64) int64 {
+	if c.ContentDefined() {
+		return c.MaxSize
+	}
+	return shardSize
+}
+
+// chunkReader cuts a stream into data shards
+type chunkReader struct {
+	reader    *bufio.Reader
+	chunker   ChunkerConfig
+	shardSize int64
+}
+
+func newChunkReader(r io.Reader, chunker ChunkerConfig, shardSize int64) *chunkReader {
+	return &chunkReader{
+		reader:    bufio.NewReaderSize(r, int(maxShardSize(chunker, shardSize))),
+		chunker:   chunker,
+		shardSize: shardSize,
+	}
+}
+
+// next reads the next data shard into buffer and returns it, or io.EOF once
+// the stream is exhausted. buffer must hold maxShardSize bytes.
+func (c *chunkReader) next(buffer []byte) ([]byte, error) {
+	if !c.chunker.ContentDefined() {
+		n, err := io.ReadFull(c.reader, buffer[:c.shardSize])
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("failed to read file: %v", err)
+		}
+		return buffer[:n], nil
+	}
+
+	data, err := c.reader.Peek(int(c.chunker.MaxSize))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+
+	size := copy(buffer, data[:c.chunker.cut(data)])
+	c.reader.Discard(size)
+	return buffer[:size], nil
+}
@@ -0,0 +1,111 @@
+package sharding
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"shard/internal/store"
+	"testing"
+)
+
+// chunkDigests returns the digests of the content defined chunks of data
+func chunkDigests(t *testing.T, data []byte) map[[32]byte]bool {
+	chunks := newChunkReader(bytes.NewReader(data), DefaultChunker(), ShardSize)
+	buffer := make([]byte, DefaultChunker().MaxSize)
+	digests := make(map[[32]byte]bool)
+	var total int64
+	for {
+		chunk, err := chunks.next(buffer)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Chunking failed: %v", err)
+		}
+		digests[sha256.Sum256(chunk)] = true
+		total += int64(len(chunk))
+	}
+	if total != int64(len(data)) {
+		t.Fatalf("Chunks cover %d bytes, expected %d", total, len(data))
+	}
+	return digests
+}
+
+// TestContentDefinedBoundariesSurviveInsert checks that a one byte insert at
+// the start of a file only changes the first chunk
+func TestContentDefinedBoundariesSurviveInsert(t *testing.T) {
+	original := make([]byte, 16*ShardSize)
+	rand.Read(original)
+	edited := append([]byte{0x42}, original...)
+
+	before := chunkDigests(t, original)
+	after := chunkDigests(t, edited)
+
+	shared := 0
+	for digest := range after {
+		if before[digest] {
+			shared++
+		}
+	}
+	if shared < len(before)-2 {
+		t.Errorf("Only %d of %d chunks survived a one byte insert", shared, len(before))
+	}
+}
+
+// TestSplitContentDefined splits and merges a file with variable size shards
+func TestSplitContentDefined(t *testing.T) {
+	tempDir := t.TempDir()
+	shardStore := store.NewMemStore()
+
+	content := make([]byte, 6*ShardSize+123)
+	rand.Read(content)
+	filePath := filepath.Join(tempDir, "testfile")
+	err := os.WriteFile(filePath, content, 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	opts := SplitOptions{
+		Chunker: DefaultChunker(),
+		Scheme:  Scheme{DataShards: 2, ParityShards: 1},
+	}
+	shards, err := SplitFile(filePath, shardStore, opts)
+	if err != nil {
+		t.Fatalf("SplitFile failed: %v", err)
+	}
+
+	// Drop the first data shard, parity has to rebuild it at its real size
+	outDir := filepath.Join(tempDir, "out")
+	err = MergeShards(shards[1:], outDir, shardStore, "merged", nil)
+	if err != nil {
+		t.Fatalf("MergeShards failed: %v", err)
+	}
+
+	merged, err := os.ReadFile(filepath.Join(outDir, "merged"))
+	if err != nil {
+		t.Fatalf("Failed to read merged file: %v", err)
+	}
+	if !bytes.Equal(merged, content) {
+		t.Errorf("Merged file differs from the original (%d vs %d bytes)", len(merged), len(content))
+	}
+}
+
+// TestContentDefinedChunkerLimit checks chunks of the largest shard size stay
+// within MaxShardSize and larger chunk configs are rejected
+func TestContentDefinedChunkerLimit(t *testing.T) {
+	chunker := ContentDefinedChunker(MaxShardSize)
+	if chunker.MaxSize != MaxShardSize {
+		t.Errorf("Expected chunks capped at %d bytes, got %d", MaxShardSize, chunker.MaxSize)
+	}
+	if err := chunker.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+
+	chunker.MaxSize = 4 * MaxShardSize
+	if err := chunker.Validate(); err == nil {
+		t.Errorf("Expected chunks larger than %d bytes to be rejected", MaxShardSize)
+	}
+}
@@ -0,0 +1,104 @@
+package sharding
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// DigestCID returns the CIDv1 of contents with the given hex SHA-256 digest.
+// The CID carries the hash function, so identifiers stay unambiguous if
+// another one is used later.
+func DigestCID(digest string) (string, error) {
+	raw, err := hex.DecodeString(digest)
+	if err != nil {
+		return "", fmt.Errorf("invalid digest %q: %v", digest, err)
+	}
+	mh, err := multihash.Encode(raw, multihash.SHA2_256)
+	if err != nil {
+		return "", fmt.Errorf("invalid digest %q: %v", digest, err)
+	}
+	return cid.NewCidV1(cid.Raw, mh).String(), nil
+}
+
+// CID returns the CID of the shard contents as stored, empty when the shard
+// has no digest
+func (s Shard) CID() string {
+	id, err := DigestCID(s.Digest)
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+// ParseFileID accepts a file identifier as a legacy hex SHA-256 or as a CID
+// and returns the key the file is stored under. SHA-256 CIDs map to their hex
+// digest so both forms name the same file, CIDs using other hash functions
+// are their own key.
+func ParseFileID(id string) (string, error) {
+	if raw, err := hex.DecodeString(id); err == nil && len(raw) == 32 {
+		return hex.EncodeToString(raw), nil
+	}
+
+	parsed, err := cid.Decode(id)
+	if err != nil {
+		return "", fmt.Errorf("%q is neither a hex SHA-256 nor a CID", id)
+	}
+	decoded, err := multihash.Decode(parsed.Hash())
+	if err != nil {
+		return "", fmt.Errorf("invalid multihash in %q: %v", id, err)
+	}
+	if decoded.Code == multihash.SHA2_256 {
+		return hex.EncodeToString(decoded.Digest), nil
+	}
+	if _, err := multihash.GetHasher(decoded.Code); err != nil {
+		return "", fmt.Errorf("unsupported hash function %s in %q", decoded.Name, id)
+	}
+	return cid.NewCidV1(parsed.Type(), parsed.Hash()).String(), nil
+}
+
+// ValidFileID reports whether id is a file key in its canonical form, as
+// ParseFileID returns it
+func ValidFileID(id string) bool {
+	key, err := ParseFileID(id)
+	return err == nil && key == id
+}
+
+// FileVerifier hashes a file with the function its key names and checks the
+// result against the key
+type FileVerifier struct {
+	hash.Hash
+	expected []byte
+}
+
+// NewFileVerifier returns a verifier for a key returned by ParseFileID
+func NewFileVerifier(key string) (*FileVerifier, error) {
+	code := uint64(multihash.SHA2_256)
+	expected, err := hex.DecodeString(key)
+	if err != nil {
+		parsed, err := cid.Decode(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file key %q", key)
+		}
+		decoded, err := multihash.Decode(parsed.Hash())
+		if err != nil {
+			return nil, fmt.Errorf("invalid multihash in %q: %v", key, err)
+		}
+		code, expected = decoded.Code, decoded.Digest
+	}
+
+	hasher, err := multihash.GetHasher(code)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported hash function for %q: %v", key, err)
+	}
+	return &FileVerifier{Hash: hasher, expected: expected}, nil
+}
+
+// Verify reports whether everything written so far hashes to the key
+func (v *FileVerifier) Verify() bool {
+	return bytes.Equal(v.Sum(nil), v.expected)
+}
@@ -0,0 +1,52 @@
+package sharding
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// TestParseFileID checks hex and CID identifiers of the same file map to the
+// same key, and that CIDs of other hash functions verify with that function
+func TestParseFileID(t *testing.T) {
+	content := []byte("addressed by content")
+	digest := ContentDigest(content)
+
+	id, err := DigestCID(digest)
+	if err != nil {
+		t.Fatalf("DigestCID failed: %v", err)
+	}
+	for _, form := range []string{digest, strings.ToUpper(digest), id} {
+		key, err := ParseFileID(form)
+		if err != nil {
+			t.Fatalf("ParseFileID(%q) failed: %v", form, err)
+		}
+		if key != digest {
+			t.Errorf("ParseFileID(%q) = %q, expected %q", form, key, digest)
+		}
+	}
+
+	mh, err := multihash.Sum(content, multihash.BLAKE3, -1)
+	if err != nil {
+		t.Fatalf("Failed to hash with BLAKE3: %v", err)
+	}
+	blake := cid.NewCidV1(cid.Raw, mh).String()
+	key, err := ParseFileID(blake)
+	if err != nil {
+		t.Fatalf("ParseFileID(%q) failed: %v", blake, err)
+	}
+	verifier, err := NewFileVerifier(key)
+	if err != nil {
+		t.Fatalf("NewFileVerifier failed: %v", err)
+	}
+	verifier.Write(content)
+	if !verifier.Verify() {
+		t.Error("BLAKE3 CID did not verify its contents")
+	}
+
+	if _, err := ParseFileID("not-an-id"); err == nil {
+		t.Error("Expected an invalid identifier to be rejected")
+	}
+}
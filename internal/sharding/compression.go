@@ -0,0 +1,71 @@
+package sharding
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs a shard can be stored with
+const (
+	CodecNone = ""
+	CodecZstd = "zstd"
+)
+
+// compressionSample is how much of a shard is test compressed before the
+// whole shard is, so incompressible data costs little CPU
+const compressionSample = 64 * 1024
+
+// Encoder and decoder are safe for concurrent EncodeAll and DecodeAll calls
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(4*MaxShardSize))
+)
+
+// ValidateCodec checks the codec is known
+func ValidateCodec(codec string) error {
+	switch codec {
+	case CodecNone, CodecZstd:
+		return nil
+	}
+	return fmt.Errorf("unknown codec %q", codec)
+}
+
+// worthCompressing reports whether compressed is small enough compared to
+// raw to be stored, it has to save at least an eighth
+func worthCompressing(raw, compressed int) bool {
+	return compressed < raw-raw/8
+}
+
+// compressShard compresses data into dst with the codec. It returns the
+// compressed bytes, which may have outgrown dst, and whether they are worth
+// storing instead of data.
+func compressShard(codec string, data []byte, dst []byte) ([]byte, bool) {
+	if codec != CodecZstd || len(data) == 0 {
+		return dst[:0], false
+	}
+	if len(data) > compressionSample {
+		sample := zstdEncoder.EncodeAll(data[:compressionSample], dst[:0])
+		if !worthCompressing(compressionSample, len(sample)) {
+			return sample, false
+		}
+		dst = sample
+	}
+	compressed := zstdEncoder.EncodeAll(data, dst[:0])
+	return compressed, worthCompressing(len(data), len(compressed))
+}
+
+// decodeShard returns the raw contents of a stored shard
+func decodeShard(shard Shard, data []byte) ([]byte, error) {
+	switch shard.Codec {
+	case CodecNone:
+		return data, nil
+	case CodecZstd:
+		raw, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress shard %d: %v", shard.Index, err)
+		}
+		return raw, nil
+	}
+	return nil, fmt.Errorf("shard %d uses unknown codec %q", shard.Index, shard.Codec)
+}
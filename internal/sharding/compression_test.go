@@ -0,0 +1,50 @@
+package sharding
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"shard/internal/store"
+	"strings"
+	"testing"
+)
+
+// TestSplitCompressed splits text, which compresses, followed by random data,
+// which doesn't, and checks both round trip through a parity rebuild
+func TestSplitCompressed(t *testing.T) {
+	tempDir := t.TempDir()
+	shardStore := store.NewMemStore()
+
+	line := "GET /file?hash=abc 200 OK\n"
+	text := strings.Repeat(line, 2*ShardSize/len(line)+1)[:2*ShardSize]
+	random := make([]byte, ShardSize)
+	rand.Read(random)
+	content := append([]byte(text), random...)
+
+	opts := SplitOptions{Scheme: Scheme{DataShards: 3, ParityShards: 1}, Codec: CodecZstd}
+	shards, err := Split(bytes.NewReader(content), "logs", shardStore, opts)
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	if shards[0].Codec != CodecZstd || shards[0].Size >= ShardSize {
+		t.Errorf("Expected the text shard to be compressed, got codec %q and %d bytes", shards[0].Codec, shards[0].Size)
+	}
+	if shards[2].Codec != CodecNone {
+		t.Errorf("Expected the random shard to be stored raw, got codec %q", shards[2].Codec)
+	}
+
+	// Drop a compressed data shard so parity has to rebuild it
+	outDir := filepath.Join(tempDir, "out")
+	err = MergeShards(shards[1:], outDir, shardStore, "merged", nil)
+	if err != nil {
+		t.Fatalf("MergeShards failed: %v", err)
+	}
+	merged, err := os.ReadFile(filepath.Join(outDir, "merged"))
+	if err != nil {
+		t.Fatalf("Failed to read merged file: %v", err)
+	}
+	if !bytes.Equal(merged, content) {
+		t.Error("Merged file differs from the original")
+	}
+}
@@ -0,0 +1,66 @@
+package sharding
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// KeySize is the size of a file key, files are encrypted with AES-256-GCM
+const KeySize = 32
+
+var (
+	// ErrKeyRequired is returned when merging encrypted shards without a key
+	ErrKeyRequired = errors.New("file is encrypted and no key was given")
+	// ErrDecryptFailed is returned when a shard that passed its digest check
+	// does not decrypt, which means the key is wrong
+	ErrDecryptFailed = errors.New("shard failed to decrypt, wrong key")
+)
+
+// NewFileKey returns a random key for a single file. Nonces are derived from
+// shard indexes, so a key must never be used for more than one file.
+func NewFileKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	return key, nil
+}
+
+// newFileCipher returns the AEAD shards of a file are sealed with
+func newFileCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// shardNonce returns the nonce of a shard, unique within a file
+func shardNonce(aead cipher.AEAD, index int) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(index))
+	return nonce
+}
+
+// encryptShard seals the stored contents of a shard
+func encryptShard(aead cipher.AEAD, index int, data []byte) []byte {
+	sealed := make([]byte, 0, len(data)+aead.Overhead())
+	return aead.Seal(sealed, shardNonce(aead, index), data, nil)
+}
+
+// decryptShard opens the contents of an encrypted shard
+func decryptShard(aead cipher.AEAD, shard Shard, data []byte) ([]byte, error) {
+	plain, err := aead.Open(nil, shardNonce(aead, shard.Index), data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: shard %d", ErrDecryptFailed, shard.Index)
+	}
+	return plain, nil
+}
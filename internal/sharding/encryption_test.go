@@ -0,0 +1,65 @@
+package sharding
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"shard/internal/store"
+	"testing"
+)
+
+// TestSplitEncrypted checks shards only hold ciphertext and the file merges
+// back with its key, and only with it
+func TestSplitEncrypted(t *testing.T) {
+	tempDir := t.TempDir()
+	shardStore := store.NewMemStore()
+	outDir := filepath.Join(tempDir, "out")
+
+	content := bytes.Repeat([]byte("top secret "), 3*ShardSize/11)
+	key, err := NewFileKey()
+	if err != nil {
+		t.Fatalf("NewFileKey failed: %v", err)
+	}
+
+	opts := SplitOptions{Scheme: Scheme{DataShards: 2, ParityShards: 1}, Codec: CodecZstd, Key: key}
+	shards, err := Split(bytes.NewReader(content), "secret", shardStore, opts)
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	for _, shard := range shards {
+		if !shard.Encrypted {
+			t.Errorf("Shard %d is not marked encrypted", shard.Index)
+		}
+		stored, err := ReadShard(shardStore, shard)
+		if err != nil {
+			t.Fatalf("Failed to read shard: %v", err)
+		}
+		if bytes.Contains(stored, []byte("top secret")) {
+			t.Errorf("Shard %d holds plaintext", shard.Index)
+		}
+	}
+
+	err = MergeShards(shards, outDir, shardStore, "merged", nil)
+	if !errors.Is(err, ErrKeyRequired) {
+		t.Errorf("Expected ErrKeyRequired without a key, got %v", err)
+	}
+	wrongKey, _ := NewFileKey()
+	err = MergeShards(shards, outDir, shardStore, "merged", wrongKey)
+	if !errors.Is(err, ErrDecryptFailed) {
+		t.Errorf("Expected ErrDecryptFailed with the wrong key, got %v", err)
+	}
+
+	// Parity has to decrypt too to rebuild the dropped shard
+	err = MergeShards(shards[1:], outDir, shardStore, "merged", key)
+	if err != nil {
+		t.Fatalf("MergeShards failed: %v", err)
+	}
+	merged, err := os.ReadFile(filepath.Join(outDir, "merged"))
+	if err != nil {
+		t.Fatalf("Failed to read merged file: %v", err)
+	}
+	if !bytes.Equal(merged, content) {
+		t.Error("Merged file differs from the original")
+	}
+}
@@ -0,0 +1,251 @@
+package sharding
+
+import "fmt"
+
+// MaxErasureShards is the largest stripe (data + parity) GF(2^8) can address
+const MaxErasureShards = 256
+
+// Scheme describes how a file was cut into shards so retrieval knows how many
+// shards are needed and which of them are parity.
+//
+// With erasure coding enabled the data shards are grouped into stripes of
+// DataShards consecutive shards, and every stripe gets ParityShards parity
+// shards. Any DataShards shards of a stripe are enough to rebuild it. Shard
+// indexes are laid out stripe by stripe: stripe s owns the indexes
+// [s*(k+m), (s+1)*(k+m)), the first k being data and the last m parity.
+type Scheme struct {
+	DataShards   int // k, zero when erasure coding is disabled
+	ParityShards int // m
+	// ShardSize is the fixed shard size, or the average one with content
+	// defined chunking, the file was split with
+	ShardSize int64
+}
+
+// Erasure reports whether the scheme uses erasure coding
+func (s Scheme) Erasure() bool {
+	return s.DataShards > 0 && s.ParityShards > 0
+}
+
+// Validate checks the scheme can be encoded
+func (s Scheme) Validate() error {
+	if s.DataShards == 0 && s.ParityShards == 0 {
+		return nil
+	}
+	if s.DataShards <= 0 || s.ParityShards <= 0 {
+		return fmt.Errorf("erasure coding needs both data and parity shards, got %d+%d", s.DataShards, s.ParityShards)
+	}
+	if s.DataShards+s.ParityShards > MaxErasureShards {
+		return fmt.Errorf("erasure coding supports at most %d shards per stripe, got %d", MaxErasureShards, s.DataShards+s.ParityShards)
+	}
+	return nil
+}
+
+// stripeWidth returns the number of indexes a stripe occupies
+func (s Scheme) stripeWidth() int {
+	return s.DataShards + s.ParityShards
+}
+
+// DataIndex returns the shard index of the n-th data shard of a file
+func (s Scheme) DataIndex(n int) int {
+	if !s.Erasure() {
+		return n
+	}
+	return (n/s.DataShards)*s.stripeWidth() + n%s.DataShards
+}
+
+// ParityIndex returns the shard index of parity shard j of the given stripe
+func (s Scheme) ParityIndex(stripe, j int) int {
+	return stripe*s.stripeWidth() + s.DataShards + j
+}
+
+// Stripe returns the stripe a shard index belongs to and its row in it
+func (s Scheme) Stripe(index int) (stripe int, row int) {
+	if !s.Erasure() {
+		return 0, index
+	}
+	return index / s.stripeWidth(), index % s.stripeWidth()
+}
+
+// IsParity reports whether the shard index holds parity data
+func (s Scheme) IsParity(index int) bool {
+	_, row := s.Stripe(index)
+	return s.Erasure() && row >= s.DataShards
+}
+
+// GF(2^8) arithmetic over the 0x11d polynomial
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// erasureCoder is a systematic Reed-Solomon coder. The encoding matrix is the
+// identity stacked on a Cauchy matrix, so every k x k submatrix is invertible.
+type erasureCoder struct {
+	k, m   int
+	matrix [][]byte // (k+m) x k
+}
+
+func newErasureCoder(scheme Scheme) (*erasureCoder, error) {
+	if err := scheme.Validate(); err != nil {
+		return nil, err
+	}
+	if !scheme.Erasure() {
+		return nil, fmt.Errorf("scheme has no parity shards")
+	}
+	k, m := scheme.DataShards, scheme.ParityShards
+	matrix := make([][]byte, k+m)
+	for r := range matrix {
+		matrix[r] = make([]byte, k)
+		for c := 0; c < k; c++ {
+			if r < k {
+				if r == c {
+					matrix[r][c] = 1
+				}
+				continue
+			}
+			// x_r = r and y_c = c are distinct, so x_r ^ y_c is never zero
+			matrix[r][c] = gfInv(byte(r) ^ byte(c))
+		}
+	}
+	return &erasureCoder{k: k, m: m, matrix: matrix}, nil
+}
+
+// encode fills parity from data. All buffers must have the same length and
+// nil data rows are treated as zeros.
+func (e *erasureCoder) encode(data [][]byte, parity [][]byte) {
+	for j := 0; j < e.m; j++ {
+		out := parity[j]
+		clear(out)
+		for i := 0; i < e.k; i++ {
+			if data[i] != nil {
+				mulAdd(out, data[i], e.matrix[e.k+j][i])
+			}
+		}
+	}
+}
+
+// reconstruct rebuilds the missing (nil) data rows of a stripe. rows holds the
+// k data rows followed by the m parity rows; present rows must all have the
+// same length. Parity rows are not rebuilt.
+func (e *erasureCoder) reconstruct(rows [][]byte) error {
+	missing := false
+	for i := 0; i < e.k; i++ {
+		if rows[i] == nil {
+			missing = true
+			break
+		}
+	}
+	if !missing {
+		return nil
+	}
+
+	// Pick the first k available rows and invert their part of the matrix
+	available := make([]int, 0, e.k)
+	for r := 0; r < e.k+e.m && len(available) < e.k; r++ {
+		if rows[r] != nil {
+			available = append(available, r)
+		}
+	}
+	if len(available) < e.k {
+		return fmt.Errorf("need %d shards to rebuild stripe, only %d available", e.k, len(available))
+	}
+
+	sub := make([][]byte, e.k)
+	for i, r := range available {
+		sub[i] = append([]byte(nil), e.matrix[r]...)
+	}
+	inverse, err := invertMatrix(sub)
+	if err != nil {
+		return err
+	}
+
+	size := len(rows[available[0]])
+	for i := 0; i < e.k; i++ {
+		if rows[i] != nil {
+			continue
+		}
+		out := make([]byte, size)
+		for j, r := range available {
+			mulAdd(out, rows[r], inverse[i][j])
+		}
+		rows[i] = out
+	}
+	return nil
+}
+
+// mulAdd computes dst ^= c * src
+func mulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	table := &gfMul[c]
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
+
+// invertMatrix inverts a square matrix in place with Gauss-Jordan elimination
+func invertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if m[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot == -1 {
+			return nil, fmt.Errorf("matrix is singular")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		scale := gfInv(m[col][col])
+		for c := 0; c < n; c++ {
+			m[col][c] = gfMul[scale][m[col][c]]
+			inv[col][c] = gfMul[scale][inv[col][c]]
+		}
+
+		for r := 0; r < n; r++ {
+			if r == col || m[r][col] == 0 {
+				continue
+			}
+			factor := m[r][col]
+			mulAdd(m[r], m[col], factor)
+			mulAdd(inv[r], inv[col], factor)
+		}
+	}
+	return inv, nil
+}
@@ -0,0 +1,66 @@
+package sharding
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"shard/internal/store"
+	"testing"
+)
+
+// TestErasureRebuild splits a file with parity, drops shards and merges it back
+func TestErasureRebuild(t *testing.T) {
+	tempDir := t.TempDir()
+	shardStore := store.NewMemStore()
+
+	// 9.5 shards worth of data leaves a short last stripe
+	content := make([]byte, 9*ShardSize+ShardSize/2)
+	rand.Read(content)
+	filePath := filepath.Join(tempDir, "testfile")
+	err := os.WriteFile(filePath, content, 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	scheme := Scheme{DataShards: 4, ParityShards: 2}
+	shards, err := SplitFile(filePath, shardStore, SplitOptions{Scheme: scheme})
+	if err != nil {
+		t.Fatalf("SplitFile failed: %v", err)
+	}
+
+	// 10 data shards in 3 stripes, each with 2 parity shards
+	if len(shards) != 16 {
+		t.Fatalf("Expected 16 shards, got %d", len(shards))
+	}
+
+	// Lose up to m shards of every stripe, data and parity alike
+	lost := map[int]bool{0: true, 3: true, 7: true, 10: true, 12: true, 17: true}
+	var kept []Shard
+	for _, shard := range shards {
+		if !lost[shard.Index] {
+			kept = append(kept, shard)
+		}
+	}
+
+	outDir := filepath.Join(tempDir, "out")
+	err = MergeShards(SortShards(kept), outDir, shardStore, "merged", nil)
+	if err != nil {
+		t.Fatalf("MergeShards failed: %v", err)
+	}
+
+	merged, err := os.ReadFile(filepath.Join(outDir, "merged"))
+	if err != nil {
+		t.Fatalf("Failed to read merged file: %v", err)
+	}
+	if !bytes.Equal(merged, content) {
+		t.Errorf("Merged file differs from the original (%d vs %d bytes)", len(merged), len(content))
+	}
+
+	// One more loss in the first stripe makes it unrecoverable
+	kept = kept[1:]
+	err = MergeShards(kept, outDir, shardStore, "merged", nil)
+	if err == nil {
+		t.Error("Expected MergeShards to fail with too few shards")
+	}
+}
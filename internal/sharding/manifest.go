@@ -0,0 +1,163 @@
+package sharding
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ManifestVersion is the manifest format written by NewManifest. Manifests
+// with a newer version are rejected rather than misread.
+const ManifestVersion = 1
+
+// Manifest describes how a file was split, so a node that knows nothing
+// about the file can fetch its manifest and then exactly the shards it lists
+type Manifest struct {
+	Version     int
+	Hash        string // hex SHA-256 of the file, which is also its name
+	Filename    string `json:",omitempty"`
+	ContentType string `json:",omitempty"`
+	Size        int64  // size of the file in bytes
+	ShardCount  int
+	ShardSize   int64
+	Scheme      Scheme
+	// Codec is the codec asked for at upload, every shard records the one
+	// it is actually stored with
+	Codec     string `json:",omitempty"`
+	Encrypted bool   `json:",omitempty"`
+	// Updated is when the file was uploaded. When it is uploaded again with
+	// other shards, the manifest updated last wins.
+	Updated time.Time `json:",omitzero"`
+	// Root is the Merkle root over the digests of Shards
+	Root   string
+	Shards []Shard
+}
+
+// NewManifest describes a file of size bytes split into shards
+func NewManifest(hash string, size int64, shards []Shard) Manifest {
+	manifest := Manifest{
+		Version:    ManifestVersion,
+		Hash:       hash,
+		Size:       size,
+		ShardCount: len(shards),
+		Root:       BuildMerkleTree(shards).Root(),
+		Shards:     make([]Shard, len(shards)),
+	}
+	for i, shard := range shards {
+		// Proofs can be rebuilt from the other digests
+		shard.Proof = nil
+		manifest.Shards[i] = shard
+		manifest.Encrypted = manifest.Encrypted || shard.Encrypted
+	}
+	if len(shards) > 0 {
+		manifest.Scheme = shards[0].Scheme
+		manifest.ShardSize = shards[0].Scheme.ShardSize
+	}
+	return manifest
+}
+
+// Validate checks the manifest is one we understand and that its shards
+// add up to its Merkle root
+func (m Manifest) Validate() error {
+	if m.Version < 1 || m.Version > ManifestVersion {
+		return fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	// The hash names the manifest's file on disk
+	if !ValidFileID(m.Hash) {
+		return fmt.Errorf("manifest has invalid file hash %q", m.Hash)
+	}
+	if len(m.Shards) != m.ShardCount {
+		return fmt.Errorf("manifest lists %d shards, expected %d", len(m.Shards), m.ShardCount)
+	}
+	for i, shard := range m.Shards {
+		if shard.Index != i {
+			return fmt.Errorf("manifest shard %d has index %d", i, shard.Index)
+		}
+		if shard.Digest == "" {
+			return fmt.Errorf("manifest shard %d has no digest", i)
+		}
+	}
+	if root := BuildMerkleTree(m.Shards).Root(); root != m.Root {
+		return fmt.Errorf("manifest shards hash to root %s, expected %s", root, m.Root)
+	}
+	return nil
+}
+
+// Shard returns the manifest entry of the shard with the given index
+func (m Manifest) Shard(index int) (Shard, bool) {
+	if index < 0 || index >= len(m.Shards) {
+		return Shard{}, false
+	}
+	return m.Shards[index], true
+}
+
+// ShardRange returns the data shards covering length bytes at offset: the
+// indexes of the first and the last one, and how far into the first one the
+// range starts
+func (m Manifest) ShardRange(offset, length int64) (int, int, int64, error) {
+	if offset < 0 || length <= 0 || offset+length > m.Size {
+		return 0, 0, 0, fmt.Errorf("range %d+%d is outside the file", offset, length)
+	}
+
+	first, last := -1, -1
+	var skip, start int64
+	for _, shard := range m.Shards {
+		if shard.IsParity() {
+			continue
+		}
+		if shard.RawSize == 0 {
+			return 0, 0, 0, fmt.Errorf("manifest does not record the size of shard %d", shard.Index)
+		}
+		end := start + shard.RawSize
+		if first == -1 && offset < end {
+			first, skip = shard.Index, offset-start
+		}
+		if offset+length <= end {
+			last = shard.Index
+			break
+		}
+		start = end
+	}
+	if first == -1 || last == -1 {
+		return 0, 0, 0, fmt.Errorf("manifest shards end before the range")
+	}
+	return first, last, skip, nil
+}
+
+// StripeShards returns the shards of the stripes holding the shards first to
+// last, which is all MergeRange needs to rebuild any of them
+func (m Manifest) StripeShards(first, last int) []Shard {
+	firstStripe, _ := m.Scheme.Stripe(first)
+	lastStripe, _ := m.Scheme.Stripe(last)
+	var shards []Shard
+	for _, shard := range m.Shards {
+		stripe, _ := m.Scheme.Stripe(shard.Index)
+		if !m.Scheme.Erasure() {
+			stripe = shard.Index
+			firstStripe, lastStripe = first, last
+		}
+		if stripe >= firstStripe && stripe <= lastStripe {
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
+
+// Encode returns the manifest as JSON
+func (m Manifest) Encode() ([]byte, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	return data, nil
+}
+
+// DecodeManifest parses and validates a manifest written by Encode
+func DecodeManifest(data []byte) (Manifest, error) {
+	var manifest Manifest
+	err := json.Unmarshal(data, &manifest)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to decode manifest: %v", err)
+	}
+	return manifest, manifest.Validate()
+}
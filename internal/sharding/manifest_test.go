@@ -0,0 +1,47 @@
+package sharding
+
+import (
+	"bytes"
+	"crypto/rand"
+	"shard/internal/store"
+	"testing"
+)
+
+// TestManifestRoundTrip encodes a manifest, decodes it back and checks a
+// tampered digest or a newer version is rejected
+func TestManifestRoundTrip(t *testing.T) {
+	content := make([]byte, 3*ShardSize+5)
+	rand.Read(content)
+	hash := ContentDigest(content)
+	opts := SplitOptions{Scheme: Scheme{DataShards: 2, ParityShards: 1}}
+	shards, err := Split(bytes.NewReader(content), hash, store.NewMemStore(), opts)
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+
+	manifest := NewManifest(hash, int64(len(content)), shards)
+	data, err := manifest.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	decoded, err := DecodeManifest(data)
+	if err != nil {
+		t.Fatalf("DecodeManifest failed: %v", err)
+	}
+	if decoded.ShardCount != len(shards) || decoded.ShardSize != ShardSize || decoded.Root != BuildMerkleTree(shards).Root() {
+		t.Errorf("Decoded manifest differs: %+v", decoded)
+	}
+
+	tampered := decoded
+	tampered.Shards = append([]Shard(nil), decoded.Shards...)
+	tampered.Shards[1].Digest = ContentDigest([]byte("other"))
+	if tampered.Validate() == nil {
+		t.Error("Expected a tampered digest to fail validation")
+	}
+
+	newer := decoded
+	newer.Version = ManifestVersion + 1
+	if newer.Validate() == nil {
+		t.Error("Expected a newer manifest version to be rejected")
+	}
+}
@@ -0,0 +1,500 @@
+package sharding
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"shard/internal/store"
+	"slices"
+	"sync"
+)
+
+// MergeWindow is how many shard groups MergeShards reads ahead of the writer.
+// A group is a single shard, or a whole stripe for erasure coded files, so
+// memory use stays bounded no matter how large the file is.
+const MergeWindow = 4
+
+// MergeContext contains parameters for merging shards
+type MergeContext struct {
+	Shards     []Shard
+	OutputDir  string
+	Store      store.ShardStore
+	OutputPath string
+	Key        []byte
+}
+
+// mergeGroup is a set of shards that is loaded, verified and written together
+type mergeGroup struct {
+	Stripe  int
+	Last    bool // last stripe of the file, which may be short
+	Shards  []Shard
+	Buffers [][]byte
+	Err     error
+}
+
+// TODO: potentially has too many arguments
+// MergeShards combines multiple shards back into the original file. Shards
+// are streamed to the output in order with a bounded read-ahead window. For
+// erasure coded files missing data shards are rebuilt from the parity shards.
+// key decrypts encrypted files and is ignored otherwise.
+func MergeShards(sortedShards []Shard, outputDir string, shards store.ShardStore, outputPath string, key []byte) error {
+	fmt.Println("Merging Shards...")
+
+	// Create merge context to hold all relevant data
+	ctx := &MergeContext{
+		Shards:     sortedShards,
+		OutputDir:  outputDir,
+		Store:      shards,
+		OutputPath: outputPath,
+		Key:        key,
+	}
+
+	groups, err := planMergeGroups(sortedShards, 0)
+	if err != nil {
+		return err
+	}
+	coder, aead, err := newMergeCoders(sortedShards, ctx.Key)
+	if err != nil {
+		return err
+	}
+
+	// Prepare output directory and file
+	outFile, err := prepareOutputFile(ctx)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	return mergeGroups(groups, coder, aead, ctx.Store, outFile)
+}
+
+// MergeRange writes length bytes of a file to w, starting skip bytes into
+// the data shard with index first. shards only has to hold the stripes that
+// cover the range, with as much parity as needed to rebuild missing shards.
+func MergeRange(sortedShards []Shard, shards store.ShardStore, key []byte, first int, skip, length int64, w io.Writer) error {
+	if len(sortedShards) == 0 {
+		return fmt.Errorf("no shards cover the range")
+	}
+	firstStripe, _ := sortedShards[0].Scheme.Stripe(first)
+	if !sortedShards[0].Scheme.Erasure() {
+		firstStripe = first
+	}
+
+	groups, err := planMergeGroups(sortedShards, firstStripe)
+	if err != nil {
+		return err
+	}
+	coder, aead, err := newMergeCoders(sortedShards, key)
+	if err != nil {
+		return err
+	}
+
+	// The first stripe may start with data shards before first
+	if coder != nil {
+		for n := firstStripe * coder.k; sortedShards[0].Scheme.DataIndex(n) < first; n++ {
+			size, ok := dataShardSize(sortedShards, sortedShards[0].Scheme.DataIndex(n))
+			if !ok {
+				return fmt.Errorf("size of shard %d is unknown", sortedShards[0].Scheme.DataIndex(n))
+			}
+			skip += size
+		}
+	}
+
+	out := &rangeWriter{writer: w, skip: skip, remaining: length}
+	err = mergeGroups(groups, coder, aead, shards, out)
+	if err != nil {
+		return err
+	}
+	if out.remaining > 0 {
+		return fmt.Errorf("shards end %d bytes before the end of the range", out.remaining)
+	}
+	return nil
+}
+
+// dataShardSize returns the raw size of a data shard, from the shard itself
+// or from the parity of its stripe
+func dataShardSize(shards []Shard, index int) (int64, bool) {
+	for _, shard := range shards {
+		if shard.Index == index && shard.RawSize > 0 {
+			return shard.RawSize, true
+		}
+	}
+	stripe, row := shards[0].Scheme.Stripe(index)
+	for _, shard := range shards {
+		if s, _ := shard.Scheme.Stripe(shard.Index); s == stripe && shard.IsParity() && row < len(shard.StripeSizes) {
+			return shard.StripeSizes[row], true
+		}
+	}
+	return 0, false
+}
+
+// rangeWriter drops the first skip bytes written to it and everything after
+// the following remaining bytes
+type rangeWriter struct {
+	writer    io.Writer
+	skip      int64
+	remaining int64
+}
+
+func (r *rangeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	drop := min(r.skip, int64(len(p)))
+	p = p[drop:]
+	r.skip -= drop
+	p = p[:min(r.remaining, int64(len(p)))]
+	if len(p) > 0 {
+		_, err := r.writer.Write(p)
+		if err != nil {
+			return 0, err
+		}
+		r.remaining -= int64(len(p))
+	}
+	return n, nil
+}
+
+// newMergeCoders returns the erasure coder and cipher the shards need, nil
+// when they are not erasure coded or not encrypted
+func newMergeCoders(shards []Shard, key []byte) (*erasureCoder, cipher.AEAD, error) {
+	var coder *erasureCoder
+	var err error
+	if len(shards) > 0 && shards[0].Scheme.Erasure() {
+		coder, err = newErasureCoder(shards[0].Scheme)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var aead cipher.AEAD
+	if slices.ContainsFunc(shards, func(s Shard) bool { return s.Encrypted }) {
+		if key == nil {
+			return nil, nil, ErrKeyRequired
+		}
+		aead, err = newFileCipher(key)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return coder, aead, nil
+}
+
+// mergeGroups loads, verifies and rebuilds the groups in order and writes
+// their data shards to w
+func mergeGroups(groups []mergeGroup, coder *erasureCoder, aead cipher.AEAD, shards store.ShardStore, w io.Writer) error {
+	var corrupt []int
+	var mergeErr error
+	for pending := range readAhead(groups, shards, MergeWindow) {
+		group := <-pending
+		if group.Err != nil {
+			if mergeErr == nil {
+				mergeErr = group.Err
+			}
+			continue
+		}
+
+		// Corrupt shards are treated as missing so parity can stand in for them
+		validShards, validBuffers, bad := verifyShardContents(group.Shards, group.Buffers)
+		corrupt = append(corrupt, bad...)
+		if mergeErr != nil {
+			// Keep reading only to report every corrupt shard at once
+			continue
+		}
+
+		validBuffers, err := decodeShardContents(validShards, validBuffers, aead)
+		if err != nil {
+			mergeErr = err
+			continue
+		}
+
+		dataShards, dataBuffers, err := rebuildGroup(coder, group, validShards, validBuffers)
+		if err == nil && !coversShards(dataShards, group.Shards, bad) {
+			err = fmt.Errorf("corrupt shards could not be rebuilt")
+		}
+		if err == nil {
+			// Write the shards to the output
+			err = writeShardBuffers(w, dataShards, dataBuffers)
+		}
+		mergeErr = err
+	}
+
+	if mergeErr != nil && len(corrupt) > 0 {
+		return errors.Join(mergeErr, &CorruptShardsError{Indexes: corrupt})
+	}
+	return mergeErr
+}
+
+// planMergeGroups splits the shards of a file into the groups MergeShards
+// processes one at a time, starting at firstStripe. Without erasure coding
+// every shard is a stripe of its own.
+func planMergeGroups(shards []Shard, firstStripe int) ([]mergeGroup, error) {
+	if len(shards) == 0 || !shards[0].Scheme.Erasure() {
+		groups := make([]mergeGroup, len(shards))
+		for i, shard := range shards {
+			if shard.Index != firstStripe+i {
+				return nil, fmt.Errorf("shard %d is missing", firstStripe+i)
+			}
+			groups[i] = mergeGroup{Stripe: shard.Index, Shards: []Shard{shard}}
+		}
+		return groups, nil
+	}
+
+	scheme := shards[0].Scheme
+	lastStripe, _ := scheme.Stripe(shards[len(shards)-1].Index)
+	if stripe, _ := scheme.Stripe(shards[0].Index); stripe < firstStripe {
+		return nil, fmt.Errorf("shard %d comes before stripe %d", shards[0].Index, firstStripe)
+	}
+	groups := make([]mergeGroup, lastStripe-firstStripe+1)
+	for i := range groups {
+		groups[i].Stripe = firstStripe + i
+		groups[i].Last = firstStripe+i == lastStripe
+	}
+	for _, shard := range shards {
+		stripe, _ := scheme.Stripe(shard.Index)
+		groups[stripe-firstStripe].Shards = append(groups[stripe-firstStripe].Shards, shard)
+	}
+	return groups, nil
+}
+
+// readAhead loads the groups in order in the background, keeping at most
+// window of them in flight. Each received channel yields one loaded group.
+// The group being written counts towards the window, so only window-1 more
+// are queued.
+func readAhead(groups []mergeGroup, shards store.ShardStore, window int) <-chan chan mergeGroup {
+	pending := make(chan chan mergeGroup, max(window-1, 0))
+	go func() {
+		defer close(pending)
+		for _, group := range groups {
+			result := make(chan mergeGroup, 1)
+			pending <- result
+			go func(g mergeGroup) {
+				g.Buffers, g.Err = loadShardContents(g.Shards, shards)
+				result <- g
+			}(group)
+		}
+	}()
+	return pending
+}
+
+// verifyShardContents drops the shards whose contents do not match their
+// digest and returns the indexes of the dropped ones
+func verifyShardContents(shards []Shard, buffers [][]byte) ([]Shard, [][]byte, []int) {
+	var validShards []Shard
+	var validBuffers [][]byte
+	var corrupt []int
+	for i, shard := range shards {
+		// Missing shards were loaded as nil
+		if buffers[i] == nil || !shard.Verify(buffers[i]) {
+			fmt.Printf("Shard %d failed digest verification\n", shard.Index)
+			corrupt = append(corrupt, shard.Index)
+			continue
+		}
+		validShards = append(validShards, shard)
+		validBuffers = append(validBuffers, buffers[i])
+	}
+	return validShards, validBuffers, corrupt
+}
+
+// decodeShardContents decrypts and decompresses verified shards, parity and
+// the rebuild work on raw contents
+func decodeShardContents(shards []Shard, buffers [][]byte, aead cipher.AEAD) ([][]byte, error) {
+	raw := make([][]byte, len(buffers))
+	for i, shard := range shards {
+		data := buffers[i]
+		var err error
+		if shard.Encrypted {
+			data, err = decryptShard(aead, shard, data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		raw[i], err = decodeShard(shard, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return raw, nil
+}
+
+// coversShards reports whether every corrupt data shard was rebuilt
+func coversShards(dataShards []Shard, shards []Shard, corrupt []int) bool {
+	for _, shard := range shards {
+		if !slices.Contains(corrupt, shard.Index) || shard.IsParity() {
+			continue
+		}
+		rebuilt := slices.ContainsFunc(dataShards, func(s Shard) bool { return s.Index == shard.Index })
+		if !rebuilt {
+			return false
+		}
+	}
+	return true
+}
+
+// rebuildGroup returns the data shards of a group in order. For erasure coded
+// files the missing ones are rebuilt from the parity shards of the stripe.
+func rebuildGroup(coder *erasureCoder, group mergeGroup, shards []Shard, buffers [][]byte) ([]Shard, [][]byte, error) {
+	if coder == nil {
+		return shards, buffers, nil
+	}
+
+	scheme := Scheme{DataShards: coder.k, ParityShards: coder.m}
+	if len(group.Shards) > 0 {
+		scheme = group.Shards[0].Scheme
+	}
+	rows := make([][]byte, coder.k+coder.m)
+	rowShards := make([]Shard, coder.k)
+	var sizes []int64
+	for i, shard := range shards {
+		_, row := scheme.Stripe(shard.Index)
+		rows[row] = buffers[i]
+		if shard.IsParity() {
+			sizes = shard.StripeSizes
+		} else {
+			rowShards[row] = shard
+		}
+	}
+
+	if sizes == nil {
+		// Without parity every data shard of the stripe must be present,
+		// and only the last stripe may hold fewer than k of them
+		for row := 0; row < coder.k && rows[row] != nil; row++ {
+			sizes = append(sizes, int64(len(rows[row])))
+		}
+		gap := slices.ContainsFunc(rows[len(sizes):coder.k], func(b []byte) bool { return b != nil })
+		if len(sizes) < coder.k && (!group.Last || gap) {
+			missing := scheme.DataIndex(group.Stripe*coder.k + len(sizes))
+			return nil, nil, fmt.Errorf("shard %d is missing and stripe %d has no parity to rebuild it", missing, group.Stripe)
+		}
+	} else {
+		err := rebuildStripe(coder, rows, sizes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to rebuild stripe %d: %v", group.Stripe, err)
+		}
+	}
+
+	var dataShards []Shard
+	var dataBuffers [][]byte
+	for row, size := range sizes {
+		shard := rowShards[row]
+		if shard.Hash == "" {
+			// Rebuilt from parity
+			shard = Shard{Index: scheme.DataIndex(group.Stripe*coder.k + row), Size: size, Scheme: scheme}
+		}
+		dataShards = append(dataShards, shard)
+		dataBuffers = append(dataBuffers, rows[row][:size])
+	}
+	return dataShards, dataBuffers, nil
+}
+
+// rebuildStripe pads the data rows of a stripe to the parity width, rebuilds
+// the missing ones and trims them back to their real size
+func rebuildStripe(coder *erasureCoder, rows [][]byte, sizes []int64) error {
+	width := 0
+	for row := coder.k; row < len(rows); row++ {
+		if rows[row] != nil {
+			width = len(rows[row])
+		}
+	}
+
+	for row := 0; row < coder.k; row++ {
+		switch {
+		case row >= len(sizes):
+			// Rows past the end of the file were encoded as zeros
+			rows[row] = make([]byte, width)
+		case rows[row] != nil && len(rows[row]) != width:
+			padded := make([]byte, width)
+			copy(padded, rows[row])
+			rows[row] = padded
+		}
+	}
+
+	if err := coder.reconstruct(rows); err != nil {
+		return err
+	}
+
+	for row, size := range sizes {
+		if int64(len(rows[row])) < size {
+			return fmt.Errorf("rebuilt shard is %d bytes, expected %d", len(rows[row]), size)
+		}
+	}
+	return nil
+}
+
+// prepareOutputFile creates the output directory and file
+func prepareOutputFile(ctx *MergeContext) (*os.File, error) {
+	err := os.MkdirAll(ctx.OutputDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+	fmt.Println("Created outputDir", ctx.OutputDir)
+
+	fullOutputPath := filepath.Join(ctx.OutputDir, ctx.OutputPath)
+	fmt.Println("outputPath", fullOutputPath)
+
+	outFile, err := os.Create(fullOutputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %v", err)
+	}
+
+	return outFile, nil
+}
+
+// ReadShard reads the stored contents of a shard into memory
+func ReadShard(shards store.ShardStore, shard Shard) ([]byte, error) {
+	reader, err := shards.Get(ShardKey(shard))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// loadShardContents reads the contents of a group's shards into memory in parallel
+func loadShardContents(shards []Shard, shardStore store.ShardStore) ([][]byte, error) {
+	var wg sync.WaitGroup
+	shardBuffers := make([][]byte, len(shards))
+	errChan := make(chan error, len(shards))
+
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(idx int, s Shard) {
+			defer wg.Done()
+			// Read shard contents into memory. A missing file is left empty
+			// so it fails verification and is reported like a corrupt shard.
+			buffer, err := ReadShard(shardStore, s)
+			if errors.Is(err, store.ErrNotFound) {
+				fmt.Printf("Shard %d is missing from the store\n", s.Index)
+				return
+			}
+			if err != nil {
+				errChan <- fmt.Errorf("failed to read shard %d: %v", s.Index, err)
+				return
+			}
+			shardBuffers[idx] = buffer
+		}(i, shard)
+	}
+
+	wg.Wait()
+	close(errChan)
+
+	for err := range errChan {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return shardBuffers, nil
+}
+
+// writeShardBuffers writes the shard buffers to the output in order
+func writeShardBuffers(w io.Writer, shards []Shard, shardBuffers [][]byte) error {
+	for i, shard := range shards {
+		fmt.Printf("Writing shard %d and size %d\n", shard.Index, shard.Size)
+		_, err := w.Write(shardBuffers[i])
+		if err != nil {
+			return fmt.Errorf("failed to write shard %d: %v", shard.Index, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package sharding
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// MerkleTree is a binary hash tree over the digests of a file's shards. Leaf
+// i holds the digest of the shard with index i; the leaf count is padded to a
+// power of two with empty leaves, so a proof only needs the shard index.
+type MerkleTree struct {
+	levels [][][]byte // levels[0] are the leaves, the last level is the root
+}
+
+// Domain separation keeps leaves and inner nodes from being confused
+const (
+	merkleLeafPrefix  = 0x00
+	merkleInnerPrefix = 0x01
+)
+
+func merkleLeaf(digest string) []byte {
+	raw, _ := hex.DecodeString(digest)
+	sum := sha256.Sum256(append([]byte{merkleLeafPrefix}, raw...))
+	return sum[:]
+}
+
+func merkleInner(left, right []byte) []byte {
+	buf := make([]byte, 0, 1+len(left)+len(right))
+	buf = append(buf, merkleInnerPrefix)
+	buf = append(buf, left...)
+	buf = append(buf, right...)
+	sum := sha256.Sum256(buf)
+	return sum[:]
+}
+
+// BuildMerkleTree builds the tree over the digests of the given shards
+func BuildMerkleTree(shards []Shard) *MerkleTree {
+	size := 1
+	for _, shard := range shards {
+		for size <= shard.Index {
+			size *= 2
+		}
+	}
+
+	leaves := make([][]byte, size)
+	for i := range leaves {
+		leaves[i] = merkleLeaf("")
+	}
+	for _, shard := range shards {
+		leaves[shard.Index] = merkleLeaf(shard.Digest)
+	}
+
+	tree := &MerkleTree{levels: [][][]byte{leaves}}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			next[i] = merkleInner(level[2*i], level[2*i+1])
+		}
+		tree.levels = append(tree.levels, next)
+		level = next
+	}
+	return tree
+}
+
+// Root returns the hex encoded root hash
+func (t *MerkleTree) Root() string {
+	return hex.EncodeToString(t.levels[len(t.levels)-1][0])
+}
+
+// Proof returns the sibling hashes from the leaf of the shard index up to the root
+func (t *MerkleTree) Proof(index int) []string {
+	proof := make([]string, 0, len(t.levels)-1)
+	for _, level := range t.levels[:len(t.levels)-1] {
+		proof = append(proof, hex.EncodeToString(level[index^1]))
+		index /= 2
+	}
+	return proof
+}
+
+// VerifyProof checks that a shard digest at the given index belongs to the
+// tree with the given root
+func VerifyProof(root string, digest string, index int, proof []string) bool {
+	if index < 0 || index >= 1<<len(proof) {
+		return false
+	}
+	node := merkleLeaf(digest)
+	for _, siblingHex := range proof {
+		sibling, err := hex.DecodeString(siblingHex)
+		if err != nil {
+			return false
+		}
+		if index%2 == 0 {
+			node = merkleInner(node, sibling)
+		} else {
+			node = merkleInner(sibling, node)
+		}
+		index /= 2
+	}
+	return hex.EncodeToString(node) == root
+}
+
+// attachProofs fills in the inclusion proof of every shard
+func attachProofs(shards []Shard) {
+	tree := BuildMerkleTree(shards)
+	for i := range shards {
+		shards[i].Proof = tree.Proof(shards[i].Index)
+	}
+}
@@ -0,0 +1,32 @@
+package sharding
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestMerkleProofs checks every shard proves against the root and that a
+// tampered digest or a wrong index does not
+func TestMerkleProofs(t *testing.T) {
+	for _, count := range []int{1, 2, 5, 8, 17} {
+		shards := make([]Shard, count)
+		for i := range shards {
+			shards[i] = Shard{Index: i, Digest: ContentDigest([]byte(fmt.Sprintf("shard %d", i)))}
+		}
+		tree := BuildMerkleTree(shards)
+		root := tree.Root()
+
+		for _, shard := range shards {
+			proof := tree.Proof(shard.Index)
+			if !VerifyProof(root, shard.Digest, shard.Index, proof) {
+				t.Errorf("%d shards: proof for shard %d does not verify", count, shard.Index)
+			}
+			if VerifyProof(root, ContentDigest([]byte("tampered")), shard.Index, proof) {
+				t.Errorf("%d shards: tampered digest for shard %d verifies", count, shard.Index)
+			}
+			if count > 1 && VerifyProof(root, shard.Digest, shard.Index^1, proof) {
+				t.Errorf("%d shards: proof for shard %d verifies at the wrong index", count, shard.Index)
+			}
+		}
+	}
+}
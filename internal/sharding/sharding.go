@@ -1,44 +1,140 @@
 package sharding
 
 import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"shard/internal/store"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
-const ShardSize = 1 * 1024 * 1024 // 1MB per shard
+const ShardSize = 1 * 1024 * 1024 // 1MB per shard unless configured otherwise
+
+// MaxShardSize bounds configurable shard sizes, every worker buffers a few
+const MaxShardSize = 64 * 1024 * 1024
+
+// MaxSplitBuffer is how many bytes of stripes Split holds at once unless
+// configured otherwise. A stripe larger than that is still read, alone.
+const MaxSplitBuffer = 256 * 1024 * 1024
+
+// ValidateShardSize checks a configured shard size
+func ValidateShardSize(size int64) error {
+	if size < 1024 || size > MaxShardSize {
+		return fmt.Errorf("shard size must be between 1KB and %d bytes, got %d", MaxShardSize, size)
+	}
+	return nil
+}
 
 type Shard struct {
 	Index int
 	Hash  string
-	Size  int64
+	// Size is the number of bytes stored, compressed shards decode to more
+	Size int64
+	// RawSize is the size of the contents before compression and encryption
+	RawSize int64 `json:",omitempty"`
+	Scheme  Scheme
+	// Codec is how the shard contents are compressed, see CodecZstd
+	Codec string `json:",omitempty"`
+	// Encrypted shards are sealed with the file key after compression
+	Encrypted bool `json:",omitempty"`
+	// Digest is the hex SHA-256 of the shard contents as stored
+	Digest string
+	// Proof ties Digest to the file's Merkle root, see MerkleTree.Proof
+	Proof []string `json:",omitempty"`
+	// StripeSizes holds, on parity shards, the sizes of the data shards of
+	// the stripe so rebuilt data shards can be trimmed to their real length
+	StripeSizes []int64 `json:",omitempty"`
+	// Replicas are the IDs of the peers the uploader sent copies to, in the
+	// order retrieval asks them
+	Replicas []string `json:",omitempty"`
+}
+
+// IsParity reports whether the shard holds erasure coding parity
+func (s Shard) IsParity() bool {
+	return s.Scheme.IsParity(s.Index)
+}
+
+// Verify reports whether data matches the shard's digest. Shards without a
+// digest cannot be verified and are accepted.
+func (s Shard) Verify(data []byte) bool {
+	return s.Digest == "" || ContentDigest(data) == s.Digest
+}
+
+// ShardKey returns the key a shard is stored under. Shards are addressed by
+// their digest, so identical contents are stored once whichever files they
+// belong to. Shards without a digest fall back to their name.
+func ShardKey(shard Shard) string {
+	if shard.Digest == "" {
+		return shard.Hash
+	}
+	return shard.Digest
+}
+
+// ContentDigest returns the hex SHA-256 of shard contents
+func ContentDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// CorruptShardsError is returned by MergeShards when shards failed digest
+// verification and the file could not be rebuilt without them
+type CorruptShardsError struct {
+	Indexes []int
+}
+
+func (e *CorruptShardsError) Error() string {
+	return fmt.Sprintf("shards %v failed digest verification", e.Indexes)
+}
+
+// SplitOptions controls how SplitFile cuts a file into shards
+type SplitOptions struct {
+	Scheme  Scheme
+	Chunker ChunkerConfig
+	// ShardSize is the size of fixed shards, ShardSize when zero. It is
+	// recorded in the scheme of every shard.
+	ShardSize int64
+	// Codec compresses every shard that shrinks enough, CodecNone when empty.
+	// Parity is computed over the uncompressed data.
+	Codec string
+	// Key encrypts every shard, data and parity alike, when set. It must be
+	// a fresh NewFileKey for every file.
+	Key []byte
+	// Workers is how many stripes are written in parallel, runtime.NumCPU()
+	// when zero. Buffers are reused between stripes.
+	Workers int
+	// MaxBuffered caps the bytes of stripes read but not yet written,
+	// MaxSplitBuffer when zero, so memory stays bounded however large the
+	// input and its shards are
+	MaxBuffered int64
 }
 
 // ShardContext contains all data needed for shard processing
 type ShardContext struct {
-	File      *os.File
-	FilePath  string
-	ShardsDir string
-	FileSize  int64
-	NumShards int64
-	Shards    []Shard
+	Name        string
+	Store       store.ShardStore
+	Scheme      Scheme
+	Codec       string
+	Cipher      cipher.AEAD
+	Coder       *erasureCoder
+	Buffers     sync.Pool
+	ShardsMutex sync.Mutex
+	Shards      []Shard
 }
 
-// ShardJob represents a single shard processing job
+// ShardJob represents a single stripe processing job. Without erasure coding
+// every stripe holds a single data shard.
 type ShardJob struct {
-	Ctx      *ShardContext
-	ShardIdx int64
-}
-
-// MergeContext contains parameters for merging shards
-type MergeContext struct {
-	Shards     []Shard
-	OutputDir  string
-	ShardsDir  string
-	OutputPath string
+	Ctx    *ShardContext
+	Stripe int
+	Data   [][]byte
 }
 
 // TODO: Refactor other parts of the code to use this function
@@ -59,79 +155,182 @@ func ShardIndex(shardPath string) (int, error) {
 	return index, nil
 }
 
-// SplitFile splits a file into multiple shards
-func SplitFile(filePath string, shardsDir string) ([]Shard, error) {
+// SplitFile splits a file into multiple shards, adding parity shards when the
+// options ask for erasure coding
+func SplitFile(filePath string, shardStore store.ShardStore, opts SplitOptions) ([]Shard, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %v", err)
 	}
 	defer file.Close()
 
-	// Create shards directory if it doesn't exist
-	err = os.MkdirAll(shardsDir, 0755)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create shards directory: %v", err)
-	}
+	return Split(file, filepath.Base(filePath), shardStore, opts)
+}
 
-	// Get file size to pre-allocate resources
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get file info: %v", err)
+// Split reads r to the end and cuts it into shards named after name. Shards
+// are written to shardStore by a pool of workers while the input is still being
+// read.
+func Split(r io.Reader, name string, shardStore store.ShardStore, opts SplitOptions) ([]Shard, error) {
+	if err := opts.Scheme.Validate(); err != nil {
+		return nil, err
 	}
-	fileSize := fileInfo.Size()
-	numShards := calculateNumberOfShards(fileSize)
-
-	// Pre-allocate shards slice
-	shards := make([]Shard, numShards)
+	if err := opts.Chunker.Validate(); err != nil {
+		return nil, err
+	}
+	if err := ValidateCodec(opts.Codec); err != nil {
+		return nil, err
+	}
+	if opts.ShardSize == 0 {
+		opts.ShardSize = ShardSize
+	}
+	if err := ValidateShardSize(opts.ShardSize); err != nil {
+		return nil, err
+	}
+	opts.Scheme.ShardSize = opts.ShardSize
 
+	var err error
 	ctx := &ShardContext{
-		File:      file,
-		FilePath:  filePath,
-		ShardsDir: shardsDir,
-		FileSize:  fileSize,
-		NumShards: numShards,
-		Shards:    shards,
+		Name:   name,
+		Store:  shardStore,
+		Scheme: opts.Scheme,
+		Codec:  opts.Codec,
+	}
+	if opts.Key != nil {
+		ctx.Cipher, err = newFileCipher(opts.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Scheme.Erasure() {
+		ctx.Coder, err = newErasureCoder(opts.Scheme)
+		if err != nil {
+			return nil, err
+		}
+	}
+	bufferSize := maxShardSize(opts.Chunker, opts.ShardSize)
+	ctx.Buffers.New = func() any {
+		buffer := make([]byte, bufferSize)
+		return &buffer
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	buffered := opts.MaxBuffered
+	if buffered <= 0 {
+		buffered = MaxSplitBuffer
 	}
 
-	err = processShards(ctx)
+	err = processShards(ctx, newChunkReader(r, opts.Chunker, opts.ShardSize), workers, newByteBudget(buffered, ctx.stripeBytes(bufferSize)))
 	if err != nil {
 		return nil, err
 	}
 
+	shards := SortShards(ctx.Shards)
+	attachProofs(shards)
+
 	return shards, nil
 }
 
-// calculateNumberOfShards determines how many shards are needed for the given file size
-func calculateNumberOfShards(fileSize int64) int64 {
-	// Round up division
-	return (fileSize + ShardSize - 1) / ShardSize
+// buffer takes a shard sized buffer from the pool
+func (ctx *ShardContext) buffer() []byte {
+	return *ctx.Buffers.Get().(*[]byte)
+}
+
+// release hands a buffer back to the pool
+func (ctx *ShardContext) release(buffer []byte) {
+	buffer = buffer[:cap(buffer)]
+	ctx.Buffers.Put(&buffer)
 }
 
-// processShards handles the parallel processing of file shards
-func processShards(ctx *ShardContext) error {
+// NameShards names shards after the file name, for shards split before the
+// name was known
+func NameShards(shards []Shard, name string) {
+	for i := range shards {
+		shards[i].Hash = buildShardHash(name, int64(shards[i].Index))
+	}
+}
+
+// stripeBytes returns the bytes of buffers a stripe holds until its shards
+// are written: its data shards and, with erasure coding, its parity
+func (ctx *ShardContext) stripeBytes(bufferSize int64) int64 {
+	if ctx.Coder == nil {
+		return bufferSize
+	}
+	return int64(ctx.Coder.k+ctx.Coder.m) * bufferSize
+}
+
+// byteBudget bounds the bytes held by stripes in flight. Each stripe takes
+// the same share, at most the whole budget.
+type byteBudget struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	free   int64
+	stripe int64
+}
+
+func newByteBudget(size, stripe int64) *byteBudget {
+	b := &byteBudget{free: max(size, stripe), stripe: stripe}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire waits until a stripe fits in the budget and takes its share
+func (b *byteBudget) acquire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.free < b.stripe {
+		b.cond.Wait()
+	}
+	b.free -= b.stripe
+}
+
+// release gives back the share of a stripe
+func (b *byteBudget) release() {
+	b.mu.Lock()
+	b.free += b.stripe
+	b.mu.Unlock()
+	b.cond.Signal()
+}
+
+// processShards reads stripes from the input while budget has room for them
+// and hands them to a bounded pool of workers
+func processShards(ctx *ShardContext, chunks *chunkReader, workers int, budget *byteBudget) error {
 	var wg sync.WaitGroup
-	errChan := make(chan error, ctx.NumShards)
+	var failed atomic.Bool
+	// The budget bounds the stripes waiting for a worker
+	jobs := make(chan *ShardJob, 1)
+	errChan := make(chan error, workers)
 
-	// Create a worker pool for parallel shard writing
-	for shardIndex := int64(0); shardIndex < ctx.NumShards; shardIndex++ {
+	for range workers {
 		wg.Add(1)
-		job := &ShardJob{
-			Ctx:      ctx,
-			ShardIdx: shardIndex,
-		}
-		go func(j *ShardJob) {
+		go func() {
 			defer wg.Done()
-			err := processOneShard(j)
-			if err != nil {
-				errChan <- err
+			for job := range jobs {
+				err := processOneStripe(job)
+				budget.release()
+				if err != nil {
+					failed.Store(true)
+					select {
+					case errChan <- err:
+					default:
+					}
+				}
 			}
-		}(job)
+		}()
 	}
 
-	// Wait for all goroutines to complete
+	readErr := readStripes(ctx, chunks, jobs, &failed, budget)
+
+	// Wait for all workers to complete
+	close(jobs)
 	wg.Wait()
 	close(errChan)
 
+	if readErr != nil {
+		return readErr
+	}
 	for err := range errChan {
 		if err != nil {
 			return err
@@ -141,149 +340,151 @@ func processShards(ctx *ShardContext) error {
 	return nil
 }
 
-// processOneShard handles the reading and writing of a single shard
-func processOneShard(job *ShardJob) error {
-	ctx := job.Ctx
-	idx := job.ShardIdx
-
-	offset := idx * ShardSize
-	currentShardSize := calculateShardSize(offset, ctx.FileSize)
-
-	buffer := make([]byte, currentShardSize)
-
-	err := readFileSegment(ctx.File, buffer, offset, currentShardSize, idx)
-	if err != nil {
-		return err
+// readStripes reads the input stripe by stripe until it ends or a worker
+// fails. Every stripe handed to jobs holds a share of budget until written.
+func readStripes(ctx *ShardContext, chunks *chunkReader, jobs chan<- *ShardJob, failed *atomic.Bool, budget *byteBudget) error {
+	perStripe := 1
+	if ctx.Coder != nil {
+		perStripe = ctx.Coder.k
 	}
 
-	shardHash := buildShardHash(ctx.FilePath, idx)
-	shardPath := filepath.Join(ctx.ShardsDir, shardHash)
-	err = os.WriteFile(shardPath, buffer, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to write shard %d: %v", idx, err)
-	}
+	for stripe := 0; !failed.Load(); stripe++ {
+		budget.acquire()
+		job := &ShardJob{Ctx: ctx, Stripe: stripe}
+		for len(job.Data) < perStripe {
+			buffer := ctx.buffer()
+			chunk, err := chunks.next(buffer)
+			if err == io.EOF {
+				ctx.release(buffer)
+				break
+			}
+			if err != nil {
+				ctx.release(buffer)
+				for _, data := range job.Data {
+					ctx.release(data)
+				}
+				budget.release()
+				return err
+			}
+			job.Data = append(job.Data, chunk)
+		}
 
-	ctx.Shards[idx] = Shard{
-		Index: int(idx),
-		Hash:  shardHash,
-		Size:  currentShardSize,
+		if len(job.Data) == 0 {
+			budget.release()
+			return nil
+		}
+		jobs <- job
+		if len(job.Data) < perStripe {
+			return nil
+		}
 	}
-
 	return nil
 }
 
-// calculateShardSize determines the size of a particular shard
-func calculateShardSize(offset int64, fileSize int64) int64 {
-	if offset+ShardSize > fileSize {
-		return fileSize - offset
-	}
-	return ShardSize
-}
+// processOneStripe writes the data shards of a stripe and, with erasure
+// coding, computes and writes its parity shards
+func processOneStripe(job *ShardJob) error {
+	ctx := job.Ctx
+	defer func() {
+		for _, data := range job.Data {
+			ctx.release(data)
+		}
+	}()
 
-// readFileSegment reads a segment of the file into a buffer
-func readFileSegment(file *os.File, buffer []byte, offset int64, size int64, idx int64) error {
-	segReader := io.NewSectionReader(file, offset, size)
-	_, err := io.ReadFull(segReader, buffer)
-	if err != nil {
-		return fmt.Errorf("error reading file segment %d: %v", idx, err)
+	perStripe := len(job.Data)
+	if ctx.Coder != nil {
+		perStripe = ctx.Coder.k
 	}
-	return nil
-}
 
-// buildShardHash constructs the full hash for a shard file
-func buildShardHash(filePath string, idx int64) string {
-	return fmt.Sprintf("%s.%d", filepath.Base(filePath), idx)
-}
-
-// TODO: potentially has too many arguments
-// MergeShards combines multiple shards back into the original file
-func MergeShards(sortedShards []Shard, outputDir, shardsDir, outputPath string) error {
-	fmt.Println("Merging Shards...")
-
-	// Create merge context to hold all relevant data
-	ctx := &MergeContext{
-		Shards:     sortedShards,
-		OutputDir:  outputDir,
-		ShardsDir:  shardsDir,
-		OutputPath: outputPath,
+	sizes := make([]int64, len(job.Data))
+	for i, data := range job.Data {
+		shardIndex := ctx.Scheme.DataIndex(job.Stripe*perStripe + i)
+		err := writeShard(ctx, shardIndex, data, nil)
+		if err != nil {
+			return err
+		}
+		sizes[i] = int64(len(data))
 	}
 
-	// Prepare output directory and file
-	outFile, err := prepareOutputFile(ctx)
-	if err != nil {
-		return err
+	if ctx.Coder == nil {
+		return nil
 	}
-	defer outFile.Close()
 
-	shardBuffers, err := loadShardContents(sortedShards, ctx.ShardsDir)
-	if err != nil {
-		return err
+	// Parity covers the largest data shard, smaller ones are zero padded
+	var width int
+	for _, data := range job.Data {
+		width = max(width, len(data))
 	}
-
-	// Write the shards to the output file
-	return writeShardBuffers(outFile, sortedShards, shardBuffers)
-}
-
-// prepareOutputFile creates the output directory and file
-func prepareOutputFile(ctx *MergeContext) (*os.File, error) {
-	err := os.MkdirAll(ctx.OutputDir, 0755)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	rows := make([][]byte, ctx.Coder.k)
+	for i, data := range job.Data {
+		rows[i] = data[:width]
+		clear(rows[i][len(data):])
 	}
-	fmt.Println("Created outputDir", ctx.OutputDir)
 
-	fullOutputPath := filepath.Join(ctx.OutputDir, ctx.OutputPath)
-	fmt.Println("outputPath", fullOutputPath)
+	parity := make([][]byte, ctx.Coder.m)
+	for j := range parity {
+		parity[j] = ctx.buffer()[:width]
+		defer ctx.release(parity[j])
+	}
+	ctx.Coder.encode(rows, parity)
 
-	outFile, err := os.Create(fullOutputPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create output file: %v", err)
+	for j, data := range parity {
+		shardIndex := ctx.Scheme.ParityIndex(job.Stripe, j)
+		err := writeShard(ctx, shardIndex, data, sizes)
+		if err != nil {
+			return err
+		}
 	}
 
-	return outFile, nil
+	return nil
 }
 
-// loadShardContents reads all shard contents into memory in parallel
-func loadShardContents(shards []Shard, shardsDir string) ([][]byte, error) {
-	var wg sync.WaitGroup
-	shardBuffers := make([][]byte, len(shards))
-	errChan := make(chan error, len(shards))
-
-	for i, shard := range shards {
-		wg.Add(1)
-		go func(idx int, s Shard) {
-			defer wg.Done()
-			// Read shard contents into memory
-			shardPath := filepath.Join(shardsDir, s.Hash)
-			buffer, err := os.ReadFile(shardPath)
-			if err != nil {
-				errChan <- fmt.Errorf("failed to read shard %d: %v", s.Index, err)
-				return
-			}
-			shardBuffers[idx] = buffer
-		}(i, shard)
+// writeShard compresses and encrypts a shard when asked to, writes it and
+// records its metadata
+func writeShard(ctx *ShardContext, shardIndex int, data []byte, stripeSizes []int64) error {
+	rawSize := int64(len(data))
+	codec := CodecNone
+	if ctx.Codec != CodecNone {
+		compressed, ok := compressShard(ctx.Codec, data, ctx.buffer())
+		// The encoder may have outgrown the pooled buffer, pool what it returned
+		defer ctx.release(compressed)
+		if ok {
+			codec, data = ctx.Codec, compressed
+		}
+	}
+	if ctx.Cipher != nil {
+		data = encryptShard(ctx.Cipher, shardIndex, data)
 	}
 
-	wg.Wait()
-	close(errChan)
+	shard := Shard{
+		Index:       shardIndex,
+		Hash:        buildShardHash(ctx.Name, int64(shardIndex)),
+		Size:        int64(len(data)),
+		RawSize:     rawSize,
+		Scheme:      ctx.Scheme,
+		Codec:       codec,
+		Encrypted:   ctx.Cipher != nil,
+		Digest:      ContentDigest(data),
+		StripeSizes: stripeSizes,
+	}
 
-	for err := range errChan {
+	// Contents we already hold, from this file or another one, are not
+	// written twice
+	if !ctx.Store.Has(ShardKey(shard)) {
+		_, err := ctx.Store.Put(shard.Digest, bytes.NewReader(data))
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("failed to write shard %d: %v", shardIndex, err)
 		}
 	}
 
-	return shardBuffers, nil
-}
+	ctx.ShardsMutex.Lock()
+	ctx.Shards = append(ctx.Shards, shard)
+	ctx.ShardsMutex.Unlock()
 
-// writeShardBuffers writes the shard buffers to the output file in order
-func writeShardBuffers(outFile *os.File, shards []Shard, shardBuffers [][]byte) error {
-	for i, shard := range shards {
-		fmt.Printf("Writing shard %d and size %d\n", shard.Index, shard.Size)
-		_, err := outFile.Write(shardBuffers[i])
-		if err != nil {
-			return fmt.Errorf("failed to write shard %d: %v", shard.Index, err)
-		}
-	}
 	return nil
 }
+
+// buildShardHash constructs the full hash for a shard file
+func buildShardHash(filePath string, idx int64) string {
+	return fmt.Sprintf("%s.%d", filepath.Base(filePath), idx)
+}
@@ -0,0 +1,315 @@
+package sharding
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"shard/internal/store"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMergeRejectsCorruptShard flips a byte in a stored shard and checks
+// MergeShards reports it, or rebuilds around it when parity is available
+func TestMergeRejectsCorruptShard(t *testing.T) {
+	tempDir := t.TempDir()
+	outDir := filepath.Join(tempDir, "out")
+
+	content := make([]byte, 3*ShardSize)
+	rand.Read(content)
+	filePath := filepath.Join(tempDir, "testfile")
+	err := os.WriteFile(filePath, content, 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	for _, scheme := range []Scheme{{}, {DataShards: 3, ParityShards: 1}} {
+		// Separate stores, both schemes have the same data shards
+		shardStore := store.NewFSStore(t.TempDir())
+		shards, err := SplitFile(filePath, shardStore, SplitOptions{Scheme: scheme})
+		if err != nil {
+			t.Fatalf("SplitFile failed: %v", err)
+		}
+
+		shardPath := shardStore.Path(ShardKey(shards[1]))
+		data, err := os.ReadFile(shardPath)
+		if err != nil {
+			t.Fatalf("Failed to read shard: %v", err)
+		}
+		data[0] ^= 0xff
+		err = os.WriteFile(shardPath, data, 0644)
+		if err != nil {
+			t.Fatalf("Failed to corrupt shard: %v", err)
+		}
+
+		err = MergeShards(shards, outDir, shardStore, "merged", nil)
+		if !scheme.Erasure() {
+			var corrupt *CorruptShardsError
+			if !errors.As(err, &corrupt) || len(corrupt.Indexes) != 1 || corrupt.Indexes[0] != 1 {
+				t.Errorf("Expected shard 1 to be reported corrupt, got %v", err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("MergeShards failed with parity available: %v", err)
+		}
+		merged, err := os.ReadFile(filepath.Join(outDir, "merged"))
+		if err != nil {
+			t.Fatalf("Failed to read merged file: %v", err)
+		}
+		if !bytes.Equal(merged, content) {
+			t.Error("Merged file differs from the original")
+		}
+	}
+}
+
+// TestSplitFromReader splits a stream that is not a file with a single worker
+func TestSplitFromReader(t *testing.T) {
+	tempDir := t.TempDir()
+	shardStore := store.NewMemStore()
+
+	content := make([]byte, 5*ShardSize+7)
+	rand.Read(content)
+
+	opts := SplitOptions{Scheme: Scheme{DataShards: 2, ParityShards: 1}, Workers: 1}
+	shards, err := Split(bytes.NewBuffer(content), "stream", shardStore, opts)
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	// 6 data shards in 3 stripes, each with 1 parity shard
+	if len(shards) != 9 {
+		t.Fatalf("Expected 9 shards, got %d", len(shards))
+	}
+
+	outDir := filepath.Join(tempDir, "out")
+	err = MergeShards(shards, outDir, shardStore, "merged", nil)
+	if err != nil {
+		t.Fatalf("MergeShards failed: %v", err)
+	}
+	merged, err := os.ReadFile(filepath.Join(outDir, "merged"))
+	if err != nil {
+		t.Fatalf("Failed to read merged file: %v", err)
+	}
+	if !bytes.Equal(merged, content) {
+		t.Error("Merged file differs from the original")
+	}
+}
+
+// busyStore counts the Puts in progress at once
+type busyStore struct {
+	store.ShardStore
+	mu      sync.Mutex
+	busy    int
+	maxBusy int
+}
+
+func (s *busyStore) Put(key string, r io.Reader) (store.Info, error) {
+	s.mu.Lock()
+	s.busy++
+	s.maxBusy = max(s.maxBusy, s.busy)
+	s.mu.Unlock()
+	time.Sleep(2 * time.Millisecond)
+	defer func() {
+		s.mu.Lock()
+		s.busy--
+		s.mu.Unlock()
+	}()
+	return s.ShardStore.Put(key, r)
+}
+
+// TestSplitBufferLimit splits with more workers than the buffer limit has
+// room for stripes and checks no more stripes than fit are written at once
+func TestSplitBufferLimit(t *testing.T) {
+	content := make([]byte, 20*1024)
+	rand.Read(content)
+	busy := &busyStore{ShardStore: store.NewMemStore()}
+
+	opts := SplitOptions{ShardSize: 1024, Workers: 8, MaxBuffered: 2 * 1024}
+	shards, err := Split(bytes.NewReader(content), "limited", busy, opts)
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	if len(shards) != 20 {
+		t.Fatalf("Expected 20 shards, got %d", len(shards))
+	}
+	if busy.maxBusy > 2 {
+		t.Errorf("Expected at most 2 stripes written at once, got %d", busy.maxBusy)
+	}
+}
+
+// TestSplitShardSize splits with a non default shard size and checks it is
+// recorded in every shard
+func TestSplitShardSize(t *testing.T) {
+	tempDir := t.TempDir()
+	shardStore := store.NewMemStore()
+
+	content := make([]byte, 10*1024+1)
+	rand.Read(content)
+
+	opts := SplitOptions{ShardSize: 4 * 1024}
+	shards, err := Split(bytes.NewReader(content), "small", shardStore, opts)
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	if len(shards) != 3 {
+		t.Fatalf("Expected 3 shards, got %d", len(shards))
+	}
+	for _, shard := range shards {
+		if shard.Scheme.ShardSize != opts.ShardSize {
+			t.Errorf("Shard %d records size %d, expected %d", shard.Index, shard.Scheme.ShardSize, opts.ShardSize)
+		}
+	}
+
+	outDir := filepath.Join(tempDir, "out")
+	err = MergeShards(shards, outDir, shardStore, "merged", nil)
+	if err != nil {
+		t.Fatalf("MergeShards failed: %v", err)
+	}
+	merged, err := os.ReadFile(filepath.Join(outDir, "merged"))
+	if err != nil {
+		t.Fatalf("Failed to read merged file: %v", err)
+	}
+	if !bytes.Equal(merged, content) {
+		t.Error("Merged file differs from the original")
+	}
+}
+
+// TestSplitDeduplicates splits two files sharing their first shard and checks
+// the shared contents are stored once
+func TestSplitDeduplicates(t *testing.T) {
+	shardStore := store.NewMemStore()
+
+	shared := make([]byte, ShardSize)
+	rand.Read(shared)
+	first := append(append([]byte(nil), shared...), "first tail"...)
+	second := append(append([]byte(nil), shared...), "second tail"...)
+
+	firstShards, err := Split(bytes.NewReader(first), "first", shardStore, SplitOptions{})
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	secondShards, err := Split(bytes.NewReader(second), "second", shardStore, SplitOptions{})
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	if firstShards[0].Digest != secondShards[0].Digest {
+		t.Fatal("Shared shards have different digests")
+	}
+
+	keys, err := shardStore.List()
+	if err != nil {
+		t.Fatalf("Failed to list shards: %v", err)
+	}
+	if len(keys) != 3 {
+		t.Errorf("Expected 3 stored shards for 4 shards, got %d", len(keys))
+	}
+}
+
+// TestMergeRange reads ranges of a file from the shards covering them only,
+// with a data shard missing when there is parity to rebuild it
+func TestMergeRange(t *testing.T) {
+	content := make([]byte, 7*ShardSize+99)
+	rand.Read(content)
+
+	schemes := []SplitOptions{
+		{},
+		{Scheme: Scheme{DataShards: 3, ParityShards: 1}, Chunker: DefaultChunker(), Codec: CodecZstd},
+	}
+	for _, opts := range schemes {
+		shardStore := store.NewMemStore()
+		shards, err := Split(bytes.NewReader(content), "ranged", shardStore, opts)
+		if err != nil {
+			t.Fatalf("Split failed: %v", err)
+		}
+		manifest := NewManifest("ranged", int64(len(content)), shards)
+
+		ranges := [][2]int64{{0, 10}, {ShardSize - 5, 10}, {3*ShardSize + 17, 2 * ShardSize}, {int64(len(content)) - 1, 1}}
+		for _, r := range ranges {
+			first, last, skip, err := manifest.ShardRange(r[0], r[1])
+			if err != nil {
+				t.Fatalf("ShardRange(%d, %d) failed: %v", r[0], r[1], err)
+			}
+			covering := manifest.StripeShards(first, last)
+			if opts.Scheme.Erasure() {
+				// Drop the first data shard, parity rebuilds it
+				covering = covering[1:]
+			}
+
+			var out bytes.Buffer
+			err = MergeRange(covering, shardStore, nil, first, skip, r[1], &out)
+			if err != nil {
+				t.Fatalf("MergeRange(%d, %d) failed: %v", r[0], r[1], err)
+			}
+			if !bytes.Equal(out.Bytes(), content[r[0]:r[0]+r[1]]) {
+				t.Errorf("Range %d+%d differs from the original", r[0], r[1])
+			}
+		}
+	}
+}
+
+// slowStore delays reading each shard less the later it comes, so loads
+// finish out of order, and writes the merged file counting how many shards
+// were read ahead of the writer
+type slowStore struct {
+	store.ShardStore
+	delays map[string]time.Duration
+
+	mu      sync.Mutex
+	out     bytes.Buffer
+	read    int
+	written int
+	maxHeld int
+}
+
+func (s *slowStore) Get(key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	s.read++
+	s.maxHeld = max(s.maxHeld, s.read-s.written)
+	s.mu.Unlock()
+	time.Sleep(s.delays[key])
+	return s.ShardStore.Get(key)
+}
+
+func (s *slowStore) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written++
+	return s.out.Write(p)
+}
+
+// TestMergeReadAhead merges shards whose loads finish out of order and checks
+// they are written in order with no more than MergeWindow held at once
+func TestMergeReadAhead(t *testing.T) {
+	content := make([]byte, 4*MergeWindow*1024)
+	rand.Read(content)
+	memStore := store.NewMemStore()
+	shards, err := Split(bytes.NewReader(content), "ahead", memStore, SplitOptions{ShardSize: 1024})
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+
+	slow := &slowStore{ShardStore: memStore, delays: make(map[string]time.Duration)}
+	for _, shard := range shards {
+		slow.delays[ShardKey(shard)] = time.Duration(len(shards)-shard.Index) * time.Millisecond
+	}
+	groups, err := planMergeGroups(shards, 0)
+	if err != nil {
+		t.Fatalf("planMergeGroups failed: %v", err)
+	}
+	err = mergeGroups(groups, nil, nil, slow, slow)
+	if err != nil {
+		t.Fatalf("mergeGroups failed: %v", err)
+	}
+
+	if !bytes.Equal(slow.out.Bytes(), content) {
+		t.Error("Merged file differs from the original")
+	}
+	if slow.maxHeld > MergeWindow {
+		t.Errorf("Expected at most %d shards held at once, got %d", MergeWindow, slow.maxHeld)
+	}
+}
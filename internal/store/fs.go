@@ -0,0 +1,242 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempPattern names the files contents are written to before they are
+// verified and renamed to their key
+const tempPattern = ".incoming-*"
+
+// fanOutLevels is how many levels of two character subdirectories keys are
+// spread over, so no directory holds more than a few thousand shards
+const fanOutLevels = 2
+
+// FSStore keeps every shard in its own file under a directory. Keys starting
+// with hex characters, which digests and shard names do, are spread over
+// subdirectories named after their first characters: ab/cd/abcd...
+type FSStore struct {
+	dir string
+}
+
+// NewFSStore returns a store over dir, which is created on the first Put
+func NewFSStore(dir string) *FSStore {
+	return &FSStore{dir: dir}
+}
+
+// Path returns the file holding the contents stored under key
+func (s *FSStore) Path(key string) string {
+	if !fansOut(key) {
+		return filepath.Join(s.dir, key)
+	}
+	parts := []string{s.dir}
+	for level := 0; level < fanOutLevels; level++ {
+		parts = append(parts, key[2*level:2*level+2])
+	}
+	return filepath.Join(append(parts, key)...)
+}
+
+// fansOut reports whether key is stored in a subdirectory
+func fansOut(key string) bool {
+	if len(key) <= 2*fanOutLevels || strings.ContainsAny(key, `/\`) {
+		return false
+	}
+	for _, c := range key[:2*fanOutLevels] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// paths returns where key may be found: its place in the layout, then the
+// flat one it has until Migrate moves it
+func (s *FSStore) paths(key string) []string {
+	if !fansOut(key) {
+		return []string{s.Path(key)}
+	}
+	return []string{s.Path(key), filepath.Join(s.dir, key)}
+}
+
+// Migrate moves the files of a flat store into the fan-out layout. It runs
+// on startup and picks up where an interrupted run stopped.
+func (s *FSStore) Migrate() error {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list shards: %v", err)
+	}
+
+	moved := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !fansOut(entry.Name()) {
+			continue
+		}
+		path := s.Path(entry.Name())
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return fmt.Errorf("error creating directory: %v", err)
+		}
+		err = os.Rename(filepath.Join(s.dir, entry.Name()), path)
+		if err != nil {
+			return fmt.Errorf("failed to move shard %s: %v", entry.Name(), err)
+		}
+		moved++
+	}
+	if moved > 0 {
+		fmt.Printf("Moved %d shards into the fan-out layout\n", moved)
+	}
+	return nil
+}
+
+func (s *FSStore) Put(key string, r io.Reader) (Info, error) {
+	// Create the directory if it doesn't exist
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return Info{}, fmt.Errorf("error creating directory: %v", err)
+	}
+
+	// Write into a temporary file, the digest is only known at the end
+	file, err := os.CreateTemp(s.dir, tempPattern)
+	if err != nil {
+		return Info{}, fmt.Errorf("error creating file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	digest := newDigestWriter()
+	_, err = io.Copy(io.MultiWriter(file, digest), r)
+	if err != nil {
+		return Info{}, fmt.Errorf("error writing file: %v", err)
+	}
+	key, err = digest.check(key)
+	if err != nil {
+		return Info{}, err
+	}
+
+	// Only complete, durable contents ever appear under their key
+	err = file.Sync()
+	if err != nil {
+		return Info{}, fmt.Errorf("error syncing file: %v", err)
+	}
+	err = file.Close()
+	if err != nil {
+		return Info{}, fmt.Errorf("error writing file: %v", err)
+	}
+	path := s.Path(key)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return Info{}, fmt.Errorf("error creating directory: %v", err)
+	}
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return Info{}, fmt.Errorf("error storing file: %v", err)
+	}
+	err = syncDir(filepath.Dir(path))
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Key: key, Size: digest.size}, nil
+}
+
+// RemoveTemp removes the temporary files of writes interrupted by a crash.
+// It must run before the store is written to.
+func (s *FSStore) RemoveTemp() error {
+	temps, err := filepath.Glob(filepath.Join(s.dir, tempPattern))
+	if err != nil {
+		return fmt.Errorf("failed to list temporary files: %v", err)
+	}
+	for _, temp := range temps {
+		fmt.Println("Removing interrupted write", temp)
+		err = os.Remove(temp)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", temp, err)
+		}
+	}
+	return nil
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("error opening directory: %v", err)
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("error syncing directory: %v", err)
+	}
+	return nil
+}
+
+func (s *FSStore) Get(key string) (io.ReadCloser, error) {
+	for _, path := range s.paths(key) {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open shard %s: %v", key, err)
+		}
+		return file, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (s *FSStore) Has(key string) bool {
+	_, err := s.Stat(key)
+	return err == nil
+}
+
+func (s *FSStore) Stat(key string) (Info, error) {
+	for _, path := range s.paths(key) {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return Info{}, fmt.Errorf("failed to stat shard %s: %v", key, err)
+		}
+		return Info{Key: key, Size: info.Size()}, nil
+	}
+	return Info{}, ErrNotFound
+}
+
+func (s *FSStore) Delete(key string) error {
+	for _, path := range s.paths(key) {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove shard %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func (s *FSStore) List() ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && path == s.dir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		// Skip writes in progress
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+		keys = append(keys, entry.Name())
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shards: %v", err)
+	}
+	return keys, nil
+}
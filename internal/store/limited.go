@@ -0,0 +1,148 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrFull is returned by Put when the contents don't fit in the store
+var ErrFull = errors.New("shard store is full")
+
+// LimitedStore tracks the bytes held by a store and refuses contents once
+// they would exceed its capacity. Stores that are DiskUsers are charged for
+// the room they take on disk rather than for the contents they hold.
+type LimitedStore struct {
+	ShardStore
+	capacity int64    // zero is unlimited
+	disk     DiskUser // nil when usage is counted from contents
+
+	mu      sync.Mutex
+	used    int64            // bytes reserved by Puts in progress, and stored unless disk counts them
+	charged map[string]int64 // sizes of the stored contents counted in used
+}
+
+// NewLimitedStore wraps inner, counting the contents it already holds
+func NewLimitedStore(inner ShardStore, capacity int64) (*LimitedStore, error) {
+	if capacity < 0 {
+		return nil, fmt.Errorf("capacity must not be negative, got %d", capacity)
+	}
+	s := &LimitedStore{ShardStore: inner, capacity: capacity, charged: make(map[string]int64)}
+	if disk, ok := inner.(DiskUser); ok {
+		s.disk = disk
+		return s, nil
+	}
+	keys, err := inner.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		info, err := inner.Stat(key)
+		if err != nil {
+			continue
+		}
+		s.used += info.Size
+		s.charged[key] = info.Size
+	}
+	return s, nil
+}
+
+// Usage returns the bytes stored and the capacity, zero when unlimited
+func (s *LimitedStore) Usage() (int64, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.usage(), s.capacity
+}
+
+// usage returns the bytes in use. The caller must hold mu.
+func (s *LimitedStore) usage() int64 {
+	if s.disk != nil {
+		return s.used + s.disk.DiskUsage()
+	}
+	return s.used
+}
+
+// Fits reports whether size more bytes can be stored
+func (s *LimitedStore) Fits(size int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.capacity == 0 || s.usage()+size <= s.capacity
+}
+
+func (s *LimitedStore) Put(key string, r io.Reader) (Info, error) {
+	// Reserve space as the contents arrive so concurrent Puts can't overshoot
+	reserved := &reservingReader{reader: r, store: s}
+	info, err := s.ShardStore.Put(key, reserved)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= reserved.size
+	if reserved.full {
+		return Info{}, ErrFull
+	}
+	// Contents are charged once, by the key they were stored under, however
+	// many Puts stored them. Disk usage counts them for DiskUsers instead.
+	if err == nil && s.disk == nil {
+		s.charge(info.Key, info.Size)
+	}
+	return info, err
+}
+
+func (s *LimitedStore) Delete(key string) error {
+	err := s.ShardStore.Delete(key)
+	// The room is given back once the store reclaims it
+	if err != nil || s.disk != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= s.charged[key]
+	delete(s.charged, key)
+	// A Put of the same contents may have stored them again meanwhile
+	if info, err := s.ShardStore.Stat(key); err == nil {
+		s.charge(key, info.Size)
+	}
+	return nil
+}
+
+// charge counts stored contents unless they already are. The caller must
+// hold mu.
+func (s *LimitedStore) charge(key string, size int64) {
+	if _, ok := s.charged[key]; ok {
+		return
+	}
+	s.charged[key] = size
+	s.used += size
+}
+
+// reserve claims size bytes, failing when they don't fit
+func (s *LimitedStore) reserve(size int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.capacity != 0 && s.usage()+size > s.capacity {
+		return false
+	}
+	s.used += size
+	return true
+}
+
+// reservingReader reserves space in the store for everything read through it
+type reservingReader struct {
+	reader io.Reader
+	store  *LimitedStore
+	size   int64
+	full   bool
+}
+
+func (r *reservingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if !r.store.reserve(int64(n)) {
+			r.full = true
+			return 0, ErrFull
+		}
+		r.size += int64(n)
+	}
+	return n, err
+}
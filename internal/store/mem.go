@@ -0,0 +1,80 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"sync"
+)
+
+// MemStore keeps shards in memory, for tests and short lived nodes
+type MemStore struct {
+	mu     sync.RWMutex
+	shards map[string][]byte
+}
+
+// NewMemStore returns an empty in-memory store
+func NewMemStore() *MemStore {
+	return &MemStore{shards: make(map[string][]byte)}
+}
+
+func (s *MemStore) Put(key string, r io.Reader) (Info, error) {
+	var buffer bytes.Buffer
+	digest := newDigestWriter()
+	_, err := io.Copy(io.MultiWriter(&buffer, digest), r)
+	if err != nil {
+		return Info{}, err
+	}
+	key, err = digest.check(key)
+	if err != nil {
+		return Info{}, err
+	}
+
+	s.mu.Lock()
+	s.shards[key] = buffer.Bytes()
+	s.mu.Unlock()
+	return Info{Key: key, Size: digest.size}, nil
+}
+
+func (s *MemStore) Get(key string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	data, ok := s.shards[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *MemStore) Has(key string) bool {
+	_, err := s.Stat(key)
+	return err == nil
+}
+
+func (s *MemStore) Stat(key string) (Info, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.shards[key]
+	if !ok {
+		return Info{}, ErrNotFound
+	}
+	return Info{Key: key, Size: int64(len(data))}, nil
+}
+
+func (s *MemStore) Delete(key string) error {
+	s.mu.Lock()
+	delete(s.shards, key)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemStore) List() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.shards))
+	for key := range s.shards {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
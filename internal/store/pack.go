@@ -0,0 +1,758 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultSegmentSize is how large a segment grows before writes move on
+	// to a new one
+	DefaultSegmentSize = 256 << 20
+
+	// compactRatio is the share of a segment that must be live for
+	// compaction to leave it alone
+	compactRatio = 0.5
+
+	segmentPrefix = "segment-"
+	segmentSuffix = ".pack"
+
+	// Records start with an op byte, the key length and the contents size
+	recordHeaderSize = 1 + 2 + 8
+	// digestKeySize is the length of the hex SHA-256 keys Put stores under
+	digestKeySize = 64
+)
+
+// Record ops. A zero op marks a Put that never completed.
+const (
+	opPut    byte = 1
+	opDelete byte = 2
+)
+
+// PackStore appends shards to large segment files instead of keeping a file
+// per shard, which saves inodes and directory updates when shards are small.
+// The index of where each key lives is rebuilt from the record headers on
+// open. Deleted and replaced contents stay in their segment until Compact
+// copies the live records out of it.
+//
+// Shards stored one per file in the same directory, as FSStore keeps them,
+// are still served until Migrate moves them into segments.
+type PackStore struct {
+	dir         string
+	segmentSize int64
+	loose       *FSStore
+
+	writeMu sync.Mutex // serializes appends and compaction
+
+	mu        sync.RWMutex
+	index     map[string]packLocation
+	segments  map[int]*segment
+	active    int   // the segment written to, zero before the first one
+	looseSize int64 // bytes of shards stored one per file
+}
+
+// segment tracks how much of a segment file is still referenced
+type segment struct {
+	size int64 // bytes of complete records
+	live int64 // bytes of records the index points at
+}
+
+// packRecord is an entry of a segment
+type packRecord struct {
+	op     byte
+	key    string
+	offset int64 // where the record starts in its segment
+	size   int64 // bytes of contents
+}
+
+func (r packRecord) length() int64 {
+	return recordHeaderSize + int64(len(r.key)) + r.size
+}
+
+func (r packRecord) dataOffset() int64 {
+	return r.offset + recordHeaderSize + int64(len(r.key))
+}
+
+func (r packRecord) header() []byte {
+	header := make([]byte, recordHeaderSize, recordHeaderSize+len(r.key))
+	header[0] = r.op
+	binary.BigEndian.PutUint16(header[1:3], uint16(len(r.key)))
+	binary.BigEndian.PutUint64(header[3:11], uint64(r.size))
+	return append(header, r.key...)
+}
+
+// packLocation is where the contents of a key are
+type packLocation struct {
+	segment int
+	packRecord
+}
+
+// NewPackStore opens the segments in dir, dropping records torn by a crash.
+// dir is created on the first Put.
+func NewPackStore(dir string) (*PackStore, error) {
+	s := &PackStore{
+		dir:         dir,
+		segmentSize: DefaultSegmentSize,
+		loose:       NewFSStore(dir),
+		index:       make(map[string]packLocation),
+		segments:    make(map[int]*segment),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"+segmentSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list segments: %v", err)
+	}
+	var ids []int
+	for _, path := range paths {
+		var id int
+		_, err := fmt.Sscanf(filepath.Base(path), segmentPrefix+"%d"+segmentSuffix, &id)
+		if err != nil || id <= 0 {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	// Later records win, so segments are replayed in the order written
+	slices.Sort(ids)
+	for _, id := range ids {
+		err = s.openSegment(id)
+		if err != nil {
+			return nil, err
+		}
+		s.active = id
+	}
+
+	loose, err := s.loose.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range loose {
+		if info, err := s.loose.Stat(key); err == nil && !isSegment(key) {
+			s.looseSize += info.Size
+		}
+	}
+	return s, nil
+}
+
+func (s *PackStore) segmentPath(id int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%08d%s", segmentPrefix, id, segmentSuffix))
+}
+
+func isSegment(name string) bool {
+	return strings.HasPrefix(name, segmentPrefix) && strings.HasSuffix(name, segmentSuffix)
+}
+
+// openSegment indexes the records of a segment and truncates whatever
+// follows the last complete one
+func (s *PackStore) openSegment(id int) error {
+	file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open segment %d: %v", id, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat segment %d: %v", id, err)
+	}
+
+	s.segments[id] = &segment{}
+	end, err := scanSegment(file, info.Size(), func(record packRecord) error {
+		s.apply(id, record)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read segment %d: %v", id, err)
+	}
+	s.segments[id].size = end
+
+	if end < info.Size() {
+		fmt.Printf("Dropping %d bytes of torn records from segment %d\n", info.Size()-end, id)
+		err = file.Truncate(end)
+		if err != nil {
+			return fmt.Errorf("failed to truncate segment %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// scanSegment calls visit for each complete record of a segment and returns
+// where the last one ends
+func scanSegment(file *os.File, size int64, visit func(packRecord) error) (int64, error) {
+	var offset int64
+	header := make([]byte, recordHeaderSize)
+	for offset+recordHeaderSize <= size {
+		_, err := file.ReadAt(header, offset)
+		if err != nil {
+			return offset, err
+		}
+		record := packRecord{
+			op:     header[0],
+			offset: offset,
+			size:   int64(binary.BigEndian.Uint64(header[3:11])),
+		}
+		keyLength := int64(binary.BigEndian.Uint16(header[1:3]))
+		if record.op != opPut && record.op != opDelete {
+			break
+		}
+		if record.size < 0 || offset+recordHeaderSize+keyLength+record.size > size {
+			break
+		}
+		key := make([]byte, keyLength)
+		_, err = file.ReadAt(key, offset+recordHeaderSize)
+		if err != nil {
+			return offset, err
+		}
+		record.key = string(key)
+
+		err = visit(record)
+		if err != nil {
+			return offset, err
+		}
+		offset += record.length()
+	}
+	return offset, nil
+}
+
+// apply updates the index with a record written to a segment. The caller
+// must hold mu or be the only one with the store.
+func (s *PackStore) apply(id int, record packRecord) {
+	if old, ok := s.index[record.key]; ok {
+		s.segments[old.segment].live -= old.length()
+		delete(s.index, record.key)
+	}
+	if record.op == opPut {
+		s.index[record.key] = packLocation{segment: id, packRecord: record}
+		s.segments[id].live += record.length()
+	}
+}
+
+// activeSegment opens the segment to append to, starting a new one when the
+// current one is full. The caller must hold writeMu.
+func (s *PackStore) activeSegment() (*os.File, int, int64, error) {
+	s.mu.RLock()
+	id := s.active
+	current, ok := s.segments[id]
+	s.mu.RUnlock()
+	if ok && current.size < s.segmentSize {
+		file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, 0)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to open segment %d: %v", id, err)
+		}
+		return file, id, current.size, nil
+	}
+	file, id, err := s.startSegment()
+	return file, id, 0, err
+}
+
+// startSegment creates a segment after the active one and makes it the
+// active one. The caller must hold writeMu.
+func (s *PackStore) startSegment() (*os.File, int, error) {
+	err := os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating directory: %v", err)
+	}
+	s.mu.RLock()
+	id := s.active + 1
+	s.mu.RUnlock()
+	file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create segment %d: %v", id, err)
+	}
+	err = syncDir(s.dir)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	s.mu.Lock()
+	s.segments[id] = &segment{}
+	s.active = id
+	s.mu.Unlock()
+	return file, id, nil
+}
+
+func (s *PackStore) Put(key string, r io.Reader) (Info, error) {
+	// Contents are staged outside the lock, so a slow sender only holds up
+	// its own write
+	err := os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return Info{}, fmt.Errorf("error creating directory: %v", err)
+	}
+	staged, err := os.CreateTemp(s.dir, tempPattern)
+	if err != nil {
+		return Info{}, fmt.Errorf("error creating file: %v", err)
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+
+	digest := newDigestWriter()
+	_, err = io.Copy(io.MultiWriter(staged, digest), r)
+	if err != nil {
+		return Info{}, fmt.Errorf("error writing file: %v", err)
+	}
+	key, err = digest.check(key)
+	if err != nil {
+		return Info{}, err
+	}
+	_, err = staged.Seek(0, io.SeekStart)
+	if err != nil {
+		return Info{}, fmt.Errorf("error reading file: %v", err)
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err = s.appendRecord(packRecord{op: opPut, key: key, size: digest.size}, staged, true)
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Key: key, Size: digest.size}, nil
+}
+
+// RemoveTemp removes contents staged by Puts a crash interrupted. It must run
+// before the store is written to.
+func (s *PackStore) RemoveTemp() error {
+	return s.loose.RemoveTemp()
+}
+
+// appendRecord writes a record to the active segment and indexes it,
+// returning the segment it went to. Contents are synced before the header
+// is written, so a header on disk never points at contents that are not.
+// Unless sync is set the caller must sync the header. The caller must hold
+// writeMu.
+func (s *PackStore) appendRecord(record packRecord, contents io.Reader, sync bool) (int, error) {
+	file, id, offset, err := s.activeSegment()
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	record.offset = offset
+	if contents != nil {
+		var written int64
+		written, err = io.Copy(io.NewOffsetWriter(file, record.dataOffset()), contents)
+		if err == nil && written != record.size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			err = file.Sync()
+		}
+	}
+	if err == nil {
+		_, err = file.WriteAt(record.header(), offset)
+	}
+	if err == nil && sync {
+		err = file.Sync()
+	}
+	if err != nil {
+		if truncateErr := file.Truncate(offset); truncateErr != nil {
+			fmt.Printf("Failed to drop partial record from segment %d: %v\n", id, truncateErr)
+		}
+		return 0, fmt.Errorf("error writing segment: %v", err)
+	}
+
+	s.mu.Lock()
+	s.segments[id].size = offset + record.length()
+	s.apply(id, record)
+	s.mu.Unlock()
+	return id, nil
+}
+
+// syncSegment makes the records appended to a segment durable
+func (s *PackStore) syncSegment(id int) error {
+	file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open segment %d: %v", id, err)
+	}
+	defer file.Close()
+	err = file.Sync()
+	if err != nil {
+		return fmt.Errorf("error syncing segment: %v", err)
+	}
+	return nil
+}
+
+// sectionReader reads contents out of a segment file
+type sectionReader struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (r sectionReader) Close() error {
+	return r.file.Close()
+}
+
+func (s *PackStore) Get(key string) (io.ReadCloser, error) {
+	// A compaction can move the contents between the lookup and the open,
+	// the index already points at their new place by then
+	for attempt := 0; ; attempt++ {
+		s.mu.RLock()
+		location, ok := s.index[key]
+		s.mu.RUnlock()
+		if !ok {
+			return s.loose.Get(key)
+		}
+		file, err := os.Open(s.segmentPath(location.segment))
+		if os.IsNotExist(err) && attempt == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open shard %s: %v", key, err)
+		}
+		return sectionReader{io.NewSectionReader(file, location.dataOffset(), location.size), file}, nil
+	}
+}
+
+func (s *PackStore) Has(key string) bool {
+	_, err := s.Stat(key)
+	return err == nil
+}
+
+func (s *PackStore) Stat(key string) (Info, error) {
+	s.mu.RLock()
+	location, ok := s.index[key]
+	s.mu.RUnlock()
+	if !ok {
+		return s.loose.Stat(key)
+	}
+	return Info{Key: key, Size: location.size}, nil
+}
+
+func (s *PackStore) Delete(key string) error {
+	err := s.deleteLoose(key)
+	if err != nil {
+		return err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.RLock()
+	_, ok := s.index[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	_, err = s.appendRecord(packRecord{op: opDelete, key: key}, nil, true)
+	if err != nil {
+		return fmt.Errorf("failed to remove shard %s: %v", key, err)
+	}
+	return nil
+}
+
+func (s *PackStore) List() ([]string, error) {
+	loose, err := s.loose.List()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.index)+len(loose))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	s.mu.RUnlock()
+	for _, key := range loose {
+		if !isSegment(key) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys), nil
+}
+
+// deleteLoose removes a shard stored in its own file, if any
+func (s *PackStore) deleteLoose(key string) error {
+	info, err := s.loose.Stat(key)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = s.loose.Delete(key)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.looseSize -= info.Size
+	s.mu.Unlock()
+	return nil
+}
+
+// DiskUsage returns the bytes the store takes, counting deleted and replaced
+// contents until they are compacted away
+func (s *PackStore) DiskUsage() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	usage := s.looseSize
+	for _, seg := range s.segments {
+		usage += seg.size
+	}
+	return usage
+}
+
+// Migrate moves shards stored one per file into segments. Shards stored
+// under their name rather than their digest stay where they are.
+func (s *PackStore) Migrate() error {
+	keys, err := s.loose.List()
+	if err != nil {
+		return err
+	}
+
+	moved := 0
+	for _, key := range keys {
+		if len(key) != digestKeySize {
+			continue
+		}
+		reader, err := s.loose.Get(key)
+		if err != nil {
+			return err
+		}
+		_, err = s.Put(key, reader)
+		reader.Close()
+		if errors.Is(err, ErrDigestMismatch) {
+			fmt.Printf("Leaving shard %s out of segments, its contents don't match\n", key)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to move shard %s: %v", key, err)
+		}
+		err = s.deleteLoose(key)
+		if err != nil {
+			return err
+		}
+		moved++
+	}
+	if moved > 0 {
+		fmt.Printf("Moved %d shards into segments\n", moved)
+	}
+	return nil
+}
+
+// Compact copies the live records out of segments that are mostly deleted
+// or replaced contents and removes those segments. When the active segment is
+// one of them and holds live records, writes move on to a new one.
+func (s *PackStore) Compact() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	records, err := s.scanRecords()
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	candidates := make(map[int]bool)
+	for id, seg := range s.segments {
+		if float64(seg.live) < compactRatio*float64(seg.size) {
+			candidates[id] = true
+		}
+	}
+	// Delete records shadowing contents in a segment that stays are kept, so
+	// a segment made mostly of those isn't worth compacting
+	for changed := true; changed; {
+		changed = false
+		for id := range candidates {
+			kept := s.segments[id].live
+			for _, record := range records[id].deletes {
+				if records.shadowed(id, record.key, candidates) {
+					kept += record.length()
+				}
+			}
+			if float64(kept) >= compactRatio*float64(s.segments[id].size) {
+				delete(candidates, id)
+				changed = true
+			}
+		}
+	}
+	active := s.active
+	var activeLive int64
+	if seg, ok := s.segments[active]; ok {
+		activeLive = seg.live
+	}
+	s.mu.RUnlock()
+	ids := slices.Sorted(maps.Keys(candidates))
+
+	// Live records can't be copied into the segment they are read from. An
+	// active segment without any is emptied in place, or left to fill up when
+	// some of its deletes are still needed.
+	if slices.Contains(ids, active) {
+		if activeLive == 0 {
+			ids = slices.DeleteFunc(ids, func(id int) bool { return id == active })
+			needed := slices.ContainsFunc(records[active].deletes, func(record packRecord) bool {
+				return records.shadowed(active, record.key, candidates)
+			})
+			if !needed {
+				err := s.emptySegment(active)
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			file, _, err := s.startSegment()
+			if err != nil {
+				return err
+			}
+			file.Close()
+		}
+	}
+
+	for _, id := range ids {
+		reclaimed, err := s.compactSegment(id, records)
+		if err != nil {
+			return err
+		}
+		delete(records, id)
+		fmt.Printf("Compacted segment %d, reclaiming %d bytes\n", id, reclaimed)
+	}
+	return nil
+}
+
+// emptySegment drops every record of a segment that holds no live ones,
+// keeping the file to write to. The caller must hold writeMu.
+func (s *PackStore) emptySegment(id int) error {
+	file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open segment %d: %v", id, err)
+	}
+	defer file.Close()
+	err = file.Truncate(0)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to empty segment %d: %v", id, err)
+	}
+
+	s.mu.Lock()
+	reclaimed := s.segments[id].size
+	s.segments[id].size = 0
+	s.mu.Unlock()
+	fmt.Printf("Compacted segment %d, reclaiming %d bytes\n", id, reclaimed)
+	return nil
+}
+
+// segmentRecords is what compaction needs to know of the records of a
+// segment: the keys it holds put records for, live or not, and its deletes
+type segmentRecords struct {
+	puts    map[string]bool
+	deletes []packRecord
+}
+
+// packRecords maps segment ids to their records
+type packRecords map[int]segmentRecords
+
+// shadowed reports whether a segment older than id, and not in skip, holds a
+// put record for key that a delete in id keeps from coming back on reopen
+func (r packRecords) shadowed(id int, key string, skip map[int]bool) bool {
+	for other, records := range r {
+		if other < id && !skip[other] && records.puts[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// scanRecords reads the record headers of every segment. The caller must
+// hold writeMu.
+func (s *PackStore) scanRecords() (packRecords, error) {
+	s.mu.RLock()
+	sizes := make(map[int]int64, len(s.segments))
+	for id, seg := range s.segments {
+		sizes[id] = seg.size
+	}
+	s.mu.RUnlock()
+
+	records := make(packRecords, len(sizes))
+	for id, size := range sizes {
+		file, err := os.Open(s.segmentPath(id))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open segment %d: %v", id, err)
+		}
+		segment := segmentRecords{puts: make(map[string]bool)}
+		_, err = scanSegment(file, size, func(record packRecord) error {
+			if record.op == opPut {
+				segment.puts[record.key] = true
+			} else {
+				segment.deletes = append(segment.deletes, record)
+			}
+			return nil
+		})
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan segment %d: %v", id, err)
+		}
+		records[id] = segment
+	}
+	return records, nil
+}
+
+// compactSegment moves the live records of a segment to the active one and
+// removes it, returning the bytes reclaimed. Delete records only move while
+// an older segment in records still holds the contents they deleted. The
+// caller must hold writeMu.
+func (s *PackStore) compactSegment(id int, records packRecords) (int64, error) {
+	file, err := os.Open(s.segmentPath(id))
+	if err != nil {
+		return 0, fmt.Errorf("failed to open segment %d: %v", id, err)
+	}
+	defer file.Close()
+
+	s.mu.RLock()
+	size, live := s.segments[id].size, s.segments[id].live
+	s.mu.RUnlock()
+
+	written := make(map[int]bool)
+	_, err = scanSegment(file, size, func(record packRecord) error {
+		s.mu.RLock()
+		location, indexed := s.index[record.key]
+		s.mu.RUnlock()
+
+		switch {
+		case record.op == opPut && indexed && location.segment == id && location.offset == record.offset:
+			contents := io.NewSectionReader(file, record.dataOffset(), record.size)
+			to, err := s.appendRecord(record, contents, false)
+			if err != nil {
+				return err
+			}
+			written[to] = true
+		case record.op == opDelete && !indexed && records.shadowed(id, record.key, nil):
+			// Without it the older put would come back on reopen
+			to, err := s.appendRecord(record, nil, false)
+			if err != nil {
+				return err
+			}
+			written[to] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to compact segment %d: %v", id, err)
+	}
+
+	// The copies must be durable before the originals go
+	for to := range written {
+		err = s.syncSegment(to)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = os.Remove(s.segmentPath(id))
+	if err != nil {
+		return 0, fmt.Errorf("failed to remove segment %d: %v", id, err)
+	}
+	err = syncDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	delete(s.segments, id)
+	s.mu.Unlock()
+	return size - live, nil
+}
@@ -0,0 +1,281 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// putShards stores count distinct shards and returns their keys
+func putShards(t *testing.T, s ShardStore, count int) []string {
+	var keys []string
+	for i := 0; i < count; i++ {
+		info, err := s.Put("", bytes.NewReader([]byte(fmt.Sprintf("shard %03d contents", i))))
+		if err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		keys = append(keys, info.Key)
+	}
+	return keys
+}
+
+func readShard(t *testing.T, s ShardStore, key string) []byte {
+	reader, err := s.Get(key)
+	if err != nil {
+		t.Fatalf("Get %s failed: %v", key, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Read %s failed: %v", key, err)
+	}
+	return data
+}
+
+// TestPackStoreCompaction deletes most of the shards in full segments and
+// checks compaction removes those segments without losing live shards or
+// bringing deleted ones back on reopen
+func TestPackStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPackStore(dir)
+	if err != nil {
+		t.Fatalf("NewPackStore failed: %v", err)
+	}
+	s.segmentSize = 400
+	keys := putShards(t, s, 20)
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "segment-*.pack"))
+	if len(segments) < 3 {
+		t.Fatalf("Expected shards to span several segments, got %v", segments)
+	}
+	for i, key := range keys {
+		if i%4 != 0 {
+			if err := s.Delete(key); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+		}
+	}
+
+	err = s.Compact()
+	if err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	compacted, _ := filepath.Glob(filepath.Join(dir, "segment-*.pack"))
+	for _, path := range compacted {
+		if path == segments[0] {
+			t.Errorf("Mostly deleted segment %s was not removed", path)
+		}
+	}
+
+	reopened, err := NewPackStore(dir)
+	if err != nil {
+		t.Fatalf("Reopening failed: %v", err)
+	}
+	for i, key := range keys {
+		if i%4 != 0 {
+			if reopened.Has(key) {
+				t.Errorf("Deleted shard %d came back after compaction", i)
+			}
+			continue
+		}
+		if data := readShard(t, reopened, key); string(data) != fmt.Sprintf("shard %03d contents", i) {
+			t.Errorf("Shard %d reads %q after compaction", i, data)
+		}
+	}
+	if listed, _ := reopened.List(); len(listed) != 5 {
+		t.Errorf("Expected 5 shards after compaction, got %d", len(listed))
+	}
+}
+
+// TestPackStoreRecovery checks records torn by a crash are dropped on open
+// and that shards stored one per file are moved into segments
+func TestPackStoreRecovery(t *testing.T) {
+	dir := t.TempDir()
+	loose := NewFSStore(dir)
+	moved := putShards(t, loose, 1)[0]
+	err := os.WriteFile(filepath.Join(dir, "legacy.0"), []byte("named shard"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write named shard: %v", err)
+	}
+
+	s, err := NewPackStore(dir)
+	if err != nil {
+		t.Fatalf("NewPackStore failed: %v", err)
+	}
+	err = s.Migrate()
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if _, err := os.Stat(loose.Path(moved)); !os.IsNotExist(err) {
+		t.Error("Shard file was not moved into a segment")
+	}
+	if data := readShard(t, s, "legacy.0"); string(data) != "named shard" {
+		t.Errorf("Named shard reads %q", data)
+	}
+	// The first one has the same contents as the migrated shard
+	kept := putShards(t, s, 3)
+
+	// A crash mid-Put leaves contents behind a header that was never written
+	segment, err := os.OpenFile(s.segmentPath(s.active), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	segment.Write(make([]byte, recordHeaderSize+digestKeySize))
+	segment.Write([]byte("torn contents"))
+	segment.Close()
+
+	reopened, err := NewPackStore(dir)
+	if err != nil {
+		t.Fatalf("Reopening failed: %v", err)
+	}
+	for _, key := range append(kept, moved) {
+		if !reopened.Has(key) {
+			t.Errorf("Shard %s was lost", key)
+		}
+	}
+	info, err := reopened.Put("", bytes.NewReader([]byte("after the crash")))
+	if err != nil {
+		t.Fatalf("Put after recovery failed: %v", err)
+	}
+	if data := readShard(t, reopened, info.Key); string(data) != "after the crash" {
+		t.Errorf("Shard written after recovery reads %q", data)
+	}
+	if keys, _ := reopened.List(); len(keys) != 5 {
+		t.Errorf("Expected 5 shards, got %v", keys)
+	}
+}
+
+// TestPackStoreSlowPut checks a Put waiting on a stalled sender doesn't hold
+// up other writes
+func TestPackStoreSlowPut(t *testing.T) {
+	s, err := NewPackStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewPackStore failed: %v", err)
+	}
+
+	stalled, sender := io.Pipe()
+	done := make(chan error)
+	go func() {
+		_, err := s.Put("", stalled)
+		done <- err
+	}()
+	sender.Write([]byte("first half, "))
+
+	written := make(chan error)
+	go func() {
+		_, err := s.Put("", bytes.NewReader([]byte("quick shard")))
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Put was blocked by a stalled sender")
+	}
+
+	sender.Write([]byte("second half"))
+	sender.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("Stalled Put failed: %v", err)
+	}
+	if keys, _ := s.List(); len(keys) != 2 {
+		t.Errorf("Expected both shards to be stored, got %v", keys)
+	}
+}
+
+// TestLimitedPackStore checks a pack store is charged for the room it takes
+// on disk, so deleted shards keep counting until they are compacted away
+func TestLimitedPackStore(t *testing.T) {
+	pack, err := NewPackStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewPackStore failed: %v", err)
+	}
+	pack.segmentSize = 200
+	s, err := NewLimitedStore(pack, 1000)
+	if err != nil {
+		t.Fatalf("NewLimitedStore failed: %v", err)
+	}
+	keys := putShards(t, s, 6)
+	stored, _ := s.Usage()
+	if stored != pack.DiskUsage() || stored <= 6*int64(len("shard 000 contents")) {
+		t.Fatalf("Expected usage to count records on disk, got %d of %d", stored, pack.DiskUsage())
+	}
+
+	for _, key := range keys[:4] {
+		if err := s.Delete(key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	deleted, _ := s.Usage()
+	if deleted < stored {
+		t.Errorf("Deleting gave back %d bytes before compaction", stored-deleted)
+	}
+
+	err = pack.Compact()
+	if err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if used, _ := s.Usage(); used >= deleted {
+		t.Errorf("Compaction did not give back any room, %d bytes used", used)
+	}
+}
+
+// TestPackStoreCompactionDropsDeletes deletes shards written after a live
+// segment and checks their delete records are not carried forward once the
+// contents are compacted away, so compaction settles and leaves the segments
+// alone
+func TestPackStoreCompactionDropsDeletes(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPackStore(dir)
+	if err != nil {
+		t.Fatalf("NewPackStore failed: %v", err)
+	}
+	s.segmentSize = 400
+	kept := putShards(t, s, 8)
+	var extra []string
+	for i := range 12 {
+		info, err := s.Put("", strings.NewReader(fmt.Sprintf("extra %03d contents", i)))
+		if err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		extra = append(extra, info.Key)
+	}
+	for _, key := range extra {
+		if err := s.Delete(key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+
+	// The active segment is left alone by the first pass
+	for range 2 {
+		err = s.Compact()
+		if err != nil {
+			t.Fatalf("Compact failed: %v", err)
+		}
+	}
+	compacted, _ := filepath.Glob(filepath.Join(dir, "segment-*.pack"))
+	err = s.Compact()
+	if err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	again, _ := filepath.Glob(filepath.Join(dir, "segment-*.pack"))
+	if !slices.Equal(again, compacted) {
+		t.Errorf("Compacting again rewrote segments %v into %v", compacted, again)
+	}
+
+	reopened, err := NewPackStore(dir)
+	if err != nil {
+		t.Fatalf("Reopening failed: %v", err)
+	}
+	if listed, _ := reopened.List(); len(listed) != len(kept) {
+		t.Errorf("Expected the %d kept shards after compaction, got %d", len(kept), len(listed))
+	}
+}
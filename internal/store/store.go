@@ -0,0 +1,90 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+var (
+	// ErrNotFound is returned for keys the store doesn't hold
+	ErrNotFound = errors.New("shard not found in store")
+	// ErrDigestMismatch is returned by Put when contents don't hash to their key
+	ErrDigestMismatch = errors.New("shard contents do not match their digest")
+)
+
+// ShardStore holds shard contents by key. Keys are the hex SHA-256 of the
+// contents, so Put verifies what it stores; shards from before content
+// addressing are read under their name.
+type ShardStore interface {
+	// Put stores the contents of r under key and returns what was stored.
+	// An empty key stores the contents under their digest.
+	Put(key string, r io.Reader) (Info, error)
+	// Get opens the contents stored under key
+	Get(key string) (io.ReadCloser, error)
+	// Has reports whether contents are stored under key
+	Has(key string) bool
+	// Stat describes the contents stored under key
+	Stat(key string) (Info, error)
+	// Delete removes the contents stored under key, if any
+	Delete(key string) error
+	// List returns every key in the store
+	List() ([]string, error)
+}
+
+// Cleaner is implemented by stores that can be left with partial writes when
+// the process dies mid-write
+type Cleaner interface {
+	RemoveTemp() error
+}
+
+// Migrator is implemented by stores whose layout on disk changed, to bring
+// existing stores up to date
+type Migrator interface {
+	Migrate() error
+}
+
+// Compactor is implemented by stores that keep deleted contents around
+// until they are compacted
+type Compactor interface {
+	Compact() error
+}
+
+// DiskUser is implemented by stores whose files take more room than the
+// contents they hold, such as deleted contents waiting for compaction
+type DiskUser interface {
+	DiskUsage() int64
+}
+
+// Info describes stored contents
+type Info struct {
+	Key  string
+	Size int64
+}
+
+// digestWriter hashes what is written through it
+type digestWriter struct {
+	hash hash.Hash
+	size int64
+}
+
+func newDigestWriter() *digestWriter {
+	return &digestWriter{hash: sha256.New()}
+}
+
+func (d *digestWriter) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	return d.hash.Write(p)
+}
+
+// check returns the key contents with this digest are stored under
+func (d *digestWriter) check(key string) (string, error) {
+	digest := hex.EncodeToString(d.hash.Sum(nil))
+	if key != "" && key != digest {
+		return "", fmt.Errorf("%w: %s", ErrDigestMismatch, key)
+	}
+	return digest, nil
+}
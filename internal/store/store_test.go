@@ -0,0 +1,225 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestStores runs the same checks against every backend
+func TestStores(t *testing.T) {
+	pack, err := NewPackStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewPackStore failed: %v", err)
+	}
+	stores := map[string]ShardStore{
+		"fs":   NewFSStore(t.TempDir()),
+		"mem":  NewMemStore(),
+		"pack": pack,
+	}
+	content := []byte("shard contents")
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+
+	for name, s := range stores {
+		info, err := s.Put("", bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("%s: Put failed: %v", name, err)
+		}
+		if info.Key != digest || info.Size != int64(len(content)) {
+			t.Errorf("%s: Put stored %+v", name, info)
+		}
+
+		_, err = s.Put(digest, bytes.NewReader([]byte("other contents")))
+		if !errors.Is(err, ErrDigestMismatch) {
+			t.Errorf("%s: Expected ErrDigestMismatch, got %v", name, err)
+		}
+
+		reader, err := s.Get(digest)
+		if err != nil {
+			t.Fatalf("%s: Get failed: %v", name, err)
+		}
+		stored, _ := io.ReadAll(reader)
+		reader.Close()
+		if !bytes.Equal(stored, content) {
+			t.Errorf("%s: Get returned %q", name, stored)
+		}
+
+		keys, err := s.List()
+		if err != nil || len(keys) != 1 || keys[0] != digest {
+			t.Errorf("%s: List returned %v, %v", name, keys, err)
+		}
+
+		err = s.Delete(digest)
+		if err != nil {
+			t.Fatalf("%s: Delete failed: %v", name, err)
+		}
+		if s.Has(digest) {
+			t.Errorf("%s: Shard still present after Delete", name)
+		}
+		if _, err := s.Get(digest); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: Expected ErrNotFound after Delete, got %v", name, err)
+		}
+	}
+}
+
+// failingReader returns some contents and then fails, like a stream cut off
+// mid-transfer
+type failingReader struct {
+	sent bool
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.sent {
+		return 0, errors.New("connection reset")
+	}
+	f.sent = true
+	return copy(p, "partial"), nil
+}
+
+// TestFSStoreInterruptedWrite checks an interrupted Put leaves nothing under
+// the key and that leftovers of a crash are removed
+func TestFSStoreInterruptedWrite(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFSStore(dir)
+
+	_, err := s.Put("", &failingReader{})
+	if err == nil {
+		t.Fatal("Expected Put to fail")
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(leftovers) != 0 {
+		t.Errorf("Interrupted Put left %v behind", leftovers)
+	}
+
+	// A crash leaves the temporary file in place
+	err = os.WriteFile(filepath.Join(dir, ".incoming-123"), []byte("partial"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %v", err)
+	}
+	err = s.RemoveTemp()
+	if err != nil {
+		t.Fatalf("RemoveTemp failed: %v", err)
+	}
+	leftovers, _ = filepath.Glob(filepath.Join(dir, ".*"))
+	if len(leftovers) != 0 {
+		t.Errorf("RemoveTemp left %v behind", leftovers)
+	}
+}
+
+// TestLimitedStore checks usage is tracked across Put and Delete and that
+// contents past the capacity are refused
+func TestLimitedStore(t *testing.T) {
+	inner := NewMemStore()
+	held, err := inner.Put("", bytes.NewReader([]byte("0123456789")))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	s, err := NewLimitedStore(inner, 20)
+	if err != nil {
+		t.Fatalf("NewLimitedStore failed: %v", err)
+	}
+	if used, _ := s.Usage(); used != 10 {
+		t.Errorf("Expected existing contents to count, got %d bytes used", used)
+	}
+
+	_, err = s.Put("", bytes.NewReader([]byte("this does not fit")))
+	if !errors.Is(err, ErrFull) {
+		t.Errorf("Expected ErrFull, got %v", err)
+	}
+	if keys, _ := s.List(); len(keys) != 1 {
+		t.Errorf("Refused contents were stored: %v", keys)
+	}
+
+	fits, err := s.Put("", bytes.NewReader([]byte("fits")))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if used, capacity := s.Usage(); used != 14 || capacity != 20 {
+		t.Errorf("Expected 14 of 20 bytes used, got %d of %d", used, capacity)
+	}
+
+	// Held contents are charged once, however often they are stored again.
+	// Without a capacity the Puts in flight can't run out of room.
+	unlimited, err := NewLimitedStore(NewMemStore(), 0)
+	if err != nil {
+		t.Fatalf("NewLimitedStore failed: %v", err)
+	}
+	var wg sync.WaitGroup
+	for _, key := range []string{fits.Key, fits.Key, "", ""} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := unlimited.Put(key, bytes.NewReader([]byte("fits"))); err != nil {
+				t.Errorf("Put failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := unlimited.Put("", bytes.NewReader([]byte("fits"))); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if used, _ := unlimited.Usage(); used != 4 {
+		t.Errorf("Expected contents stored five times to count once, got %d bytes used", used)
+	}
+
+	err = s.Delete(held.Key)
+	if err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if used, _ := s.Usage(); used != 4 {
+		t.Errorf("Expected 4 bytes used after Delete, got %d", used)
+	}
+}
+
+// TestFSStoreMigrate moves a flat store into the fan-out layout and checks
+// shards stay readable before, during and after the move
+func TestFSStoreMigrate(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("flat shard")
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+
+	// A store written before the fan-out layout
+	for _, name := range []string{digest, "notes.txt"} {
+		err := os.WriteFile(filepath.Join(dir, name), content, 0644)
+		if err != nil {
+			t.Fatalf("Failed to write flat shard: %v", err)
+		}
+	}
+
+	s := NewFSStore(dir)
+	if !s.Has(digest) {
+		t.Error("Flat shard is not found before migrating")
+	}
+	err := s.Migrate()
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+
+	expected := filepath.Join(dir, digest[:2], digest[2:4], digest)
+	if s.Path(digest) != expected {
+		t.Errorf("Expected %s in the fan-out layout, got %s", digest, s.Path(digest))
+	}
+	if _, err := os.Stat(expected); err != nil {
+		t.Errorf("Shard was not moved: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("Keys that don't fan out should stay in place: %v", err)
+	}
+
+	keys, err := s.List()
+	if err != nil || len(keys) != 2 {
+		t.Errorf("Expected both keys to be listed, got %v, %v", keys, err)
+	}
+	if keys, err := NewFSStore(filepath.Join(dir, "missing")).List(); err != nil || len(keys) != 0 {
+		t.Errorf("Expected an empty list for a missing directory, got %v, %v", keys, err)
+	}
+}
@@ -1,8 +1,112 @@
 package types
 
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"shard/internal/sharding"
+	"time"
+)
+
 type Node interface {
-	DistributeFile(filePath string)
+	DistributeFile(name string, r io.Reader, opts UploadOptions) (string, error)
 	RequestFileFromPeers(hash string) error
+	OpenFile(hash string) (*os.File, error)
+	IsCached(hash string) bool
+	CacheStats() CacheStats
+	ScrubStats() ScrubStats
+	DecryptFileFromPeers(hash string, key []byte, w io.Writer) error
+	FileManifest(hash string) (sharding.Manifest, error)
+	VerifiedManifest(hash string) (sharding.Manifest, bool)
+	ReadFileRange(hash string, key []byte, offset, length int64, w io.Writer) error
+	DeleteFile(hash string) error
 	PrintShardsMap()
+	StorageUsage() []Usage
 	Close() error
 }
+
+// UploadOptions holds the per-upload settings chosen by the client
+type UploadOptions struct {
+	// Erasure coding: every DataShards data shards get ParityShards parity
+	// shards. Both zero disables erasure coding.
+	DataShards   int
+	ParityShards int
+
+	// Chunker picks how shard boundaries are chosen: ChunkerFixed (the
+	// default) or ChunkerContentDefined
+	Chunker string
+
+	// ShardSize overrides the node's shard size, the average one with
+	// content defined chunking. Zero keeps the node default.
+	ShardSize int64
+
+	// Compression is the codec shards are compressed with, CompressionZstd
+	// or empty for none. Shards that don't shrink are stored raw.
+	Compression string
+
+	// Key encrypts the shards of the file, nil stores them in the clear. It
+	// has to be a fresh key, see sharding.NewFileKey.
+	Key []byte
+
+	// Replicas is how many distinct peers each shard is sent to, zero keeps
+	// the node default
+	Replicas int
+
+	// Filename and ContentType of the upload, recorded in the manifest
+	Filename    string
+	ContentType string
+}
+
+const (
+	ChunkerFixed          = "fixed"
+	ChunkerContentDefined = "cdc"
+
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+)
+
+// CacheStats describes the cache of reconstructed files
+type CacheStats struct {
+	Files     int
+	Size      int64
+	MaxSize   int64 // zero is unlimited
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+// ScrubStats describes the background re-hashing of stored shards
+type ScrubStats struct {
+	Running       bool
+	Passes        int
+	LastStarted   time.Time
+	LastFinished  time.Time
+	ShardsChecked int64
+	BytesChecked  int64
+	Corrupt       int64 // shards that failed verification
+	Repaired      int64 // corrupt shards fetched again from peers
+	Unrepaired    int64 // corrupt shards no peer could replace
+}
+
+// ErrFileDeleted is returned for files deleted from the network, until they
+// are uploaded again or their tombstone expires.
+var ErrFileDeleted = errors.New("file was deleted")
+
+// Usage is how much shard storage a node uses
+type Usage struct {
+	Peer     string
+	Used     int64
+	Capacity int64 // zero is unlimited
+}
+
+// IntegrityError is returned when a file was rebuilt from its shards but does
+// not hash back to the requested hash
+type IntegrityError struct {
+	Hash    string
+	Suspect []int // indexes of the shards that may hold bad data
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("reconstructed file does not match hash %s, suspect shards: %v", e.Hash, e.Suspect)
+}